@@ -0,0 +1,62 @@
+package sharding
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff returns delay before the next attempt, e.g. a retry or a
+// circuit breaker check. Attempts are numbered from 1.
+type Backoff interface {
+	NextDelay(attempt int) time.Duration
+}
+
+type constantBackoff time.Duration
+
+// ConstantBackoff returns Backoff that always waits d.
+func ConstantBackoff(d time.Duration) Backoff {
+	return constantBackoff(d)
+}
+
+func (b constantBackoff) NextDelay(attempt int) time.Duration {
+	return time.Duration(b)
+}
+
+type exponentialBackoff struct {
+	min, max time.Duration
+	jitter   bool
+}
+
+// ExponentialBackoff returns Backoff that waits min before the first
+// attempt and doubles the delay on each next attempt up to max.
+func ExponentialBackoff(min, max time.Duration) Backoff {
+	return &exponentialBackoff{
+		min: min,
+		max: max,
+	}
+}
+
+// ExponentialJitterBackoff returns Backoff that waits random duration
+// between zero and the delay of ExponentialBackoff, so clients that
+// failed at the same time do not retry at the same time.
+func ExponentialJitterBackoff(min, max time.Duration) Backoff {
+	return &exponentialBackoff{
+		min:    min,
+		max:    max,
+		jitter: true,
+	}
+}
+
+func (b *exponentialBackoff) NextDelay(attempt int) time.Duration {
+	d := b.min
+	for i := 1; i < attempt && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	if b.jitter && d > 0 {
+		d = time.Duration(rand.Int63n(int64(d) + 1))
+	}
+	return d
+}
@@ -0,0 +1,46 @@
+package sharding_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-pg/sharding"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	b := sharding.ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond)
+	wanted := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		50 * time.Millisecond,
+		50 * time.Millisecond,
+	}
+	for i, d := range wanted {
+		if got := b.NextDelay(i + 1); got != d {
+			t.Fatalf("attempt %d: got %s, wanted %s", i+1, got, d)
+		}
+	}
+}
+
+func TestExponentialJitterBackoff(t *testing.T) {
+	b := sharding.ExponentialJitterBackoff(10*time.Millisecond, 50*time.Millisecond)
+	for attempt := 1; attempt < 10; attempt++ {
+		max := sharding.ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond).
+			NextDelay(attempt)
+		for i := 0; i < 100; i++ {
+			if got := b.NextDelay(attempt); got < 0 || got > max {
+				t.Fatalf("attempt %d: got %s, wanted [0, %s]", attempt, got, max)
+			}
+		}
+	}
+}
+
+func TestConstantBackoff(t *testing.T) {
+	b := sharding.ConstantBackoff(time.Second)
+	for attempt := 1; attempt < 5; attempt++ {
+		if got := b.NextDelay(attempt); got != time.Second {
+			t.Fatalf("attempt %d: got %s, wanted 1s", attempt, got)
+		}
+	}
+}
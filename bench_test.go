@@ -73,3 +73,22 @@ func BenchmarkSubCluster(b *testing.B) {
 		}
 	})
 }
+
+var shardSink *pg.DB
+
+func BenchmarkSplitShard(b *testing.B) {
+	db := pg.Connect(&pg.Options{})
+	defer db.Close()
+
+	cluster := sharding.NewCluster([]*pg.DB{db}, 2048)
+	defer cluster.Close()
+
+	id := sharding.DefaultIdGen.NextId(time.Now(), 1234, 1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		shardSink = cluster.SplitShard(id)
+	}
+}
@@ -0,0 +1,147 @@
+package sharding
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// ErrCircuitOpen is returned by ForEach* methods for shards on a server
+// which circuit breaker is open.
+var ErrCircuitOpen = errors.New("sharding: circuit breaker is open")
+
+// CircuitBreakerOptions configures per-server circuit breaker.
+type CircuitBreakerOptions struct {
+	// Number of consecutive failures after which the circuit is opened.
+	// Only connection errors, e.g. refused connection or pool timeout,
+	// are counted as failures. Default is 5.
+	MaxFailures int
+	// Time during which calls to the server fail fast with ErrCircuitOpen.
+	// After cooldown a single call is allowed to check the server.
+	// Default is 10 seconds.
+	Cooldown time.Duration
+	// Backoff returns cooldown for the n-th time the circuit is opened
+	// in a row without a successful call in between.
+	// Default is ConstantBackoff(Cooldown).
+	Backoff Backoff
+}
+
+func (opt *CircuitBreakerOptions) init() {
+	if opt.MaxFailures == 0 {
+		opt.MaxFailures = 5
+	}
+	if opt.Cooldown == 0 {
+		opt.Cooldown = 10 * time.Second
+	}
+	if opt.Backoff == nil {
+		opt.Backoff = ConstantBackoff(opt.Cooldown)
+	}
+}
+
+type circuitBreaker struct {
+	opt *CircuitBreakerOptions
+
+	mu        sync.Mutex
+	failures  int
+	opens     int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(opt *CircuitBreakerOptions) *circuitBreaker {
+	// Defaults are set on a copy, so the caller's options are not modified.
+	cp := *opt
+	cp.init()
+	return &circuitBreaker{
+		opt: &cp,
+	}
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.opt.MaxFailures {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// Half-open: let this call through and keep others waiting
+	// until it finishes.
+	b.openUntil = now.Add(b.opt.Backoff.NextDelay(b.opens))
+	return true
+}
+
+func (b *circuitBreaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.opens = 0
+		b.openUntil = time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.opt.MaxFailures {
+		b.opens++
+		b.openUntil = time.Now().Add(b.opt.Backoff.NextDelay(b.opens))
+	}
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.opt.MaxFailures && time.Now().Before(b.openUntil)
+}
+
+// withBreaker calls the fn through the server's circuit breaker. Only
+// connection errors are counted as failures; other errors such as
+// constraint violations mean that the server responded, so they are
+// counted as successes.
+func (cl *Cluster) withBreaker(server *pg.DB, fn func() error) error {
+	b := cl.breakers[server]
+	if b == nil {
+		return fn()
+	}
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+	err := fn()
+	if isServerError(err) {
+		b.done(err)
+	} else {
+		b.done(nil)
+	}
+	return err
+}
+
+// isServerError reports whether the err means that the server could not
+// be reached, as opposed to an error returned by the fn or the query.
+func isServerError(err error) bool {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if isConnError(e) || IsPoolTimeout(e) {
+			return true
+		}
+		if _, ok := e.(net.Error); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenCircuits returns servers which circuit breaker is open.
+func (cl *Cluster) OpenCircuits() []*pg.DB {
+	var servers []*pg.DB
+	for _, db := range cl.servers {
+		if b := cl.breakers[db]; b != nil && b.isOpen() {
+			servers = append(servers, db)
+		}
+	}
+	return servers
+}
@@ -0,0 +1,162 @@
+package sharding
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// ExecOneError is returned by ExecOneForEachShard when the query does not
+// affect exactly one row on some of the shards.
+type ExecOneError struct {
+	// Affected maps id of every mismatched shard to the number of rows
+	// affected on that shard.
+	Affected map[int64]int
+}
+
+func (e *ExecOneError) Error() string {
+	ids := make([]int64, 0, len(e.Affected))
+	for id := range e.Affected {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	var b bytes.Buffer
+	b.WriteString("sharding: expected 1 affected row on each shard, got")
+	for i, id := range ids {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(" shard")
+		b.WriteString(strconv.FormatInt(id, 10))
+		b.WriteByte('=')
+		b.WriteString(strconv.Itoa(e.Affected[id]))
+	}
+	return b.String()
+}
+
+// ExecOneForEachShard executes the query on every shard in the cluster
+// and returns number of affected rows keyed by shard id. It returns
+// *ExecOneError if the query did not affect exactly one row on some of
+// the shards. Shards on servers disabled with DisableServer are not
+// modified and fail with *ShardError wrapping ErrServerDisabled.
+func (cl *Cluster) ExecOneForEachShard(
+	query interface{}, params ...interface{},
+) (map[int64]int, error) {
+	var mu sync.Mutex
+	affected := make(map[int64]int, len(cl.shards))
+	err := cl.ForEachShard(func(shard *pg.DB) error {
+		if cl.isShardDisabled(ShardId(shard)) {
+			return &ShardError{
+				ShardId: ShardId(shard),
+				Err:     ErrServerDisabled,
+			}
+		}
+		res, err := shard.Exec(query, params...)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		affected[ShardId(shard)] = res.RowsAffected()
+		mu.Unlock()
+		return nil
+	}, WithDisabled())
+	if err != nil {
+		return affected, err
+	}
+
+	var mismatched map[int64]int
+	for id, n := range affected {
+		if n == 1 {
+			continue
+		}
+		if mismatched == nil {
+			mismatched = make(map[int64]int)
+		}
+		mismatched[id] = n
+	}
+	if mismatched != nil {
+		return affected, &ExecOneError{Affected: mismatched}
+	}
+	return affected, nil
+}
+
+// ServersError is returned by ExecOnServers when the statement fails
+// on some of the servers.
+type ServersError struct {
+	// Errors maps every failed server to its error.
+	Errors map[*pg.DB]error
+}
+
+func (e *ServersError) Error() string {
+	keys := make([]string, 0, len(e.Errors))
+	errs := make(map[string]error, len(e.Errors))
+	for db, err := range e.Errors {
+		key := serverKey(db)
+		keys = append(keys, key)
+		errs[key] = err
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString("sharding: statement failed on ")
+	b.WriteString(strconv.Itoa(len(keys)))
+	b.WriteString(" server(s):")
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteString(": ")
+		b.WriteString(errs[key].Error())
+	}
+	return b.String()
+}
+
+// ExecOnServers concurrently executes the statement once on every server
+// in the cluster, including disabled ones, rather than on every shard.
+// It is useful for statements that are not scoped to a shard schema,
+// e.g. CREATE EXTENSION. It returns results keyed by server and
+// *ServersError if the statement failed on some of the servers.
+func (cl *Cluster) ExecOnServers(
+	query interface{}, params ...interface{},
+) (map[*pg.DB]orm.Result, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[*pg.DB]orm.Result, len(cl.servers))
+	errs := make(map[*pg.DB]error)
+	for _, db := range cl.servers {
+		wg.Add(1)
+		go func(db *pg.DB) {
+			defer wg.Done()
+
+			conn := db
+			if cl.ctx != nil {
+				conn = db.WithContext(cl.ctx)
+			}
+			res, err := conn.Exec(query, params...)
+
+			mu.Lock()
+			if err != nil {
+				errs[db] = err
+			} else {
+				results[db] = res
+			}
+			mu.Unlock()
+		}(db)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return results, &ServersError{Errors: errs}
+	}
+	return results, nil
+}
@@ -0,0 +1,163 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/types"
+)
+
+// ShardError is returned when an operation fails on the shard.
+type ShardError struct {
+	ShardId int64
+	Err     error
+}
+
+func (err *ShardError) Error() string {
+	return fmt.Sprintf("sharding: shard%d: %s", err.ShardId, err.Err)
+}
+
+func (err *ShardError) Unwrap() error {
+	return err.Err
+}
+
+// DeleteByIds groups the ids by shard and concurrently deletes rows with
+// these ids from the table in each affected shard's schema using single
+// DELETE ... WHERE id = ANY(...) statement per shard. It returns total
+// number of deleted rows. The table name is quoted as an identifier.
+// Errors are returned as *ShardError; shards on servers disabled with
+// DisableServer are not modified and fail with ErrServerDisabled.
+func (cl *Cluster) DeleteByIds(ctx context.Context, table string, ids []int64) (int, error) {
+	return cl.DeleteByIdsInOrder(ctx, []DeleteStep{{Table: table}}, ids)
+}
+
+// DeleteStep deletes rows of the Table which Column matches the ids.
+type DeleteStep struct {
+	Table string
+	// Column is compared with the ids. Default is id.
+	Column string
+}
+
+// DeleteByIdsInOrder is like DeleteByIds, but executes the steps in
+// order in a transaction on each affected shard, e.g. to delete child
+// rows before their parents. If any step fails the shard's transaction
+// is rolled back and *ShardError is returned; other shards are not
+// affected. It returns total number of rows deleted by all steps on
+// shards that committed.
+func (cl *Cluster) DeleteByIdsInOrder(
+	ctx context.Context, steps []DeleteStep, ids []int64,
+) (int, error) {
+	groups := cl.GroupByShard(ids)
+
+	var mu sync.Mutex
+	var deleted int
+	err := cl.ForEachShard(func(shard *pg.DB) error {
+		shardId := ShardId(shard)
+		shardIds, ok := groups[shardId]
+		if !ok {
+			return nil
+		}
+		if cl.isShardDisabled(shardId) {
+			return &ShardError{
+				ShardId: shardId,
+				Err:     ErrServerDisabled,
+			}
+		}
+
+		var n int
+		err := shard.WithContext(ctx).RunInTransaction(func(tx *pg.Tx) error {
+			for _, step := range steps {
+				column := step.Column
+				if column == "" {
+					column = "id"
+				}
+				res, err := tx.Exec(`DELETE FROM ?shard.? WHERE ? = ANY(?)`,
+					types.Q(quoteIdent(step.Table)), types.Q(quoteIdent(column)),
+					pg.Array(shardIds))
+				if err != nil {
+					return err
+				}
+				n += res.RowsAffected()
+			}
+			return nil
+		})
+		if err != nil {
+			return &ShardError{
+				ShardId: shardId,
+				Err:     err,
+			}
+		}
+
+		mu.Lock()
+		deleted += n
+		mu.Unlock()
+		return nil
+	}, WithContext(ctx), WithDisabled())
+	return deleted, err
+}
+
+// CountRows concurrently counts rows of the table in every shard's schema
+// and returns the total. The table name is quoted as an identifier. If
+// counting fails on some shards, it returns the total of the other shards
+// together with *ShardsError that lists the failed shards.
+func (cl *Cluster) CountRows(ctx context.Context, table string) (int64, error) {
+	var mu sync.Mutex
+	var total int64
+	err := cl.ForEachShard(func(shard *pg.DB) error {
+		// Shards on disabled servers are read with the read-only pool.
+		shard = cl.route(ShardId(shard))
+
+		var n int64
+		_, err := shard.WithContext(ctx).QueryOne(pg.Scan(&n),
+			`SELECT count(*) FROM ?shard.?`, types.Q(quoteIdent(table)))
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		total += n
+		mu.Unlock()
+		return nil
+	}, WithContext(ctx), WithDisabled(), WithContinueOnError())
+	return total, err
+}
+
+// MaxId concurrently queries maximum id in the table on every shard and
+// returns the greatest one, e.g. to resume a backfill. Empty shards are
+// ignored; zero is returned if the table is empty on all shards. The
+// table name is quoted as an identifier. If the query fails on some
+// shards, it returns *ShardsError that lists the failed shards.
+func (cl *Cluster) MaxId(ctx context.Context, table string) (int64, error) {
+	var mu sync.Mutex
+	var maxId int64
+	var ok bool
+	err := cl.ForEachShard(func(shard *pg.DB) error {
+		// Shards on disabled servers are read with the read-only pool.
+		shard = cl.route(ShardId(shard))
+
+		var id sql.NullInt64
+		err := QueryScalar(shard.WithContext(ctx), &id,
+			`SELECT max(id) FROM ?shard.?`, types.Q(quoteIdent(table)))
+		if err != nil {
+			return err
+		}
+		if !id.Valid {
+			return nil
+		}
+
+		mu.Lock()
+		if !ok || id.Int64 > maxId {
+			maxId = id.Int64
+			ok = true
+		}
+		mu.Unlock()
+		return nil
+	}, WithContext(ctx), WithDisabled(), WithContinueOnError())
+	if err != nil {
+		return 0, err
+	}
+	return maxId, nil
+}
@@ -1,37 +1,278 @@
 package sharding
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
 	"github.com/go-pg/pg/types"
 )
 
+// ErrNoShards is returned by methods that route an id to a shard when
+// the cluster has no shards.
+var ErrNoShards = errors.New("sharding: cluster has no shards")
+
+// ClusterOptions configures a Cluster created with NewClusterWithOptions.
+type ClusterOptions struct {
+	// IdGen is used to split ids into shard ids.
+	// Default is DefaultIdGen.
+	IdGen *IdGen
+
+	// Hash maps a key to a number that is used to pick a shard
+	// in ShardForKey. Default is 64-bit FNV-1a.
+	Hash func(key []byte) uint64
+
+	// TimeBucket maps a timestamp to a bucket number that is used to pick
+	// a shard in ShardForTime. Default is number of whole weeks since
+	// Unix epoch.
+	TimeBucket func(t time.Time) int64
+
+	// CircuitBreaker enables per-server circuit breaker in ForEach*
+	// methods. Default is no circuit breaker.
+	CircuitBreaker *CircuitBreakerOptions
+
+	// Replicas maps servers to their read replicas, which are used by
+	// ReplicaShard and ReplicaLag.
+	Replicas map[*pg.DB]*pg.DB
+
+	// RouteOverride is consulted by SplitShard, GroupByShard and
+	// SplitShardBatch before the shard id is extracted from the id with
+	// SplitId. If it returns ok the id is routed to the returned shard id
+	// instead, e.g. to pin a tenant to a dedicated shard.
+	RouteOverride func(id int64) (shardId int64, ok bool)
+
+	// Fallback routes ids that can't be resolved to a shard, i.e. negative
+	// ids and ids with shard id out of range (e.g. legacy ids), to
+	// a designated shard in SplitShard, GroupByShard and SplitShardBatch.
+	// Default is to wrap such shard ids in SplitShard and GroupByShard
+	// and to report an error in SplitShardBatch.
+	Fallback *FallbackOptions
+
+	// Params are set with WithParam on every shard in addition to
+	// shard_id, shard and epoch params, which can't be overridden.
+	Params map[string]interface{}
+
+	// ApplicationName, if set, is reported as application_name of
+	// connections of a shard with shard id appended, e.g. "app/shard42".
+	// With SearchPath every connection belongs to a single shard and is
+	// tagged when it is opened. Otherwise connections are shared by all
+	// shards on a server, so they are only tagged while they are pinned
+	// to a single shard by Pin, TryAdvisoryLock and
+	// ForEachShardWithConnection, and keep application_name of the dbs
+	// passed to the constructor the rest of the time.
+	ApplicationName string
+
+	// DefaultTimeout is set with pg.DB.WithTimeout as read/write timeout
+	// of every shard, so a single runaway query can't hang the caller.
+	// It can be overridden for a shard with WithTimeout. Default is to
+	// use timeouts of the dbs passed to the constructor.
+	DefaultTimeout time.Duration
+	// PoolTimeout is the time to wait for a free connection in the pool
+	// of a server, after which ForEach* methods return ErrPoolTimeout.
+	// StatementTimeout is set as statement_timeout of every connection,
+	// so the server cancels statements that run longer. Unlike
+	// DefaultTimeout it does not break the connection when a statement
+	// is cancelled. If either of them or RateLimits is set, the cluster
+	// opens its own pools to the servers with options of the dbs passed
+	// to the constructor and closes them with the cluster. Default is to
+	// use options of the dbs.
+	PoolTimeout      time.Duration
+	StatementTimeout time.Duration
+
+	// RateLimits maps servers to their rate limits. Every query executed
+	// on a shard of the server takes a token before it is sent and so
+	// does WaitRateLimit. Default is no rate limits.
+	RateLimits map[*pg.DB]*RateLimit
+
+	// QueryLogger is called for every query executed on shards.
+	// Default is no logging.
+	QueryLogger QueryLogger
+	// RedactParams hides query args from QueryLogger.
+	RedactParams bool
+	// SlowQueryThreshold makes QueryLogger log only queries that took
+	// at least the threshold. Default is to log all queries.
+	SlowQueryThreshold time.Duration
+	// Tracer creates spans for queries executed on shards and for
+	// ForEachShard calls. Default is no tracing.
+	Tracer Tracer
+
+	// StablePlacement assigns shards to dbs sorted by server network,
+	// address, user and database rather than in the order dbs are passed
+	// to the constructor, so reordering dbs does not move shards to
+	// different servers.
+	StablePlacement bool
+	// ConsistentHashing places shards on servers using a consistent hash
+	// ring built from server network, address, user and database, so
+	// adding or removing a server only moves shards onto or off that
+	// server. Servers get roughly, but not exactly, equal number of
+	// shards; listing a server in dbs several times gives it
+	// proportionally more shards.
+	ConsistentHashing bool
+
+	// AllowPartial makes the constructor ping every server and mark
+	// unreachable ones instead of assuming all servers are live. ForEach*
+	// methods skip shards on unreachable servers and report them with
+	// ErrServerUnreachable. Servers stay marked until Cluster.RecheckServers
+	// finds them reachable. The constructor panics if no server is
+	// reachable.
+	AllowPartial bool
+	// PingTimeout bounds pings of AllowPartial and RecheckServers, so an
+	// unresponsive server does not block for the whole dial timeout.
+	// Default is 5 seconds.
+	PingTimeout time.Duration
+
+	// SearchPath gives every shard its own pool of connections which
+	// search_path is set to the shard's schema when they are opened, so
+	// unqualified table names resolve to the shard's schema and queries
+	// don't need ?shard param. Connections are never shared between
+	// shards, so search_path doesn't have to be reset when a connection
+	// is returned to the pool. PoolSize of the db is divided between
+	// shards placed on it, so a server gets at most PoolSize connections.
+	// The constructor panics if a db has more shards than PoolSize.
+	SearchPath bool
+
+	// VerifyLayout makes the constructor panic if Cluster.VerifyLayout
+	// returns an error.
+	VerifyLayout bool
+	// VerifySchemas makes the constructor panic if Cluster.VerifySchemas
+	// returns an error, i.e. if schemas of some shards do not exist.
+	VerifySchemas bool
+}
+
+// FallbackOptions configures routing of unresolvable ids.
+type FallbackOptions struct {
+	// ShardId is id of the shard that unresolvable ids are routed to,
+	// e.g. a quarantine shard.
+	ShardId int64
+	// OnFallback, if not nil, is called with the id and its shard id
+	// every time the id is routed to the fallback shard, e.g. to count
+	// malformed ids.
+	OnFallback func(id, shardId int64)
+}
+
+func (opt *ClusterOptions) init() {
+	if opt.IdGen == nil {
+		opt.IdGen = DefaultIdGen
+	}
+	if opt.Hash == nil {
+		opt.Hash = fnvHash
+	}
+	if opt.TimeBucket == nil {
+		opt.TimeBucket = weekBucket
+	}
+}
+
+const week = 7 * 24 * time.Hour
+
+func weekBucket(t time.Time) int64 {
+	sec := t.Unix()
+	n := sec / int64(week/time.Second)
+	if sec < 0 && sec%int64(week/time.Second) != 0 {
+		n--
+	}
+	return n
+}
+
+func fnvHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
 // Cluster maps many (up to 2048) logical database shards implemented
 // using PostgreSQL schemas to far fewer physical PostgreSQL servers.
+//
+// Cluster is safe for concurrent use. Placement of shards on servers is
+// fixed at construction and never mutated, so Shard, SplitShard and
+// ForEach* methods read it without locking. The only mutable state is
+// the set of servers disabled with DisableServer: it is kept in an
+// immutable value that is swapped atomically, so each call observes
+// either the old or the new routing and never a partially updated one.
+// ForEach* methods take a single snapshot of enabled servers when they
+// start.
 type Cluster struct {
+	opt     *ClusterOptions
 	gen     *IdGen
 	servers []*pg.DB
 	dbs     []*pg.DB
 	shards  []*pg.DB
+
+	// serverByKey maps server key to the server in servers.
+	serverByKey map[string]*pg.DB
+	// shardServers maps shard index to the server in servers.
+	shardServers []*pg.DB
+
+	disabled *disabledState
+	ctx      context.Context
+
+	breakers map[*pg.DB]*circuitBreaker
+	limiters map[*pg.DB]*tokenBucket
+
+	// unreachable contains servers that could not be pinged
+	// with AllowPartial.
+	unreachable *unreachableState
+
+	replicas      map[*pg.DB]*pg.DB
+	replicaShards []*pg.DB
+
+	// refs counts clusters created with Clone that share the dbs.
+	refs *refCount
+	// searchPaths contains per-shard pools used with SearchPath.
+	searchPaths *searchPathPools
+	// pools contains pools used with PoolTimeout, StatementTimeout and
+	// RateLimits.
+	pools *serverPools
+}
+
+type refCount struct {
+	mu sync.Mutex
+	n  int
 }
 
 // NewClusterWithGen returns new PostgreSQL cluster consisting of physical
 // dbs and running nshards logical shards.
 func NewClusterWithGen(dbs []*pg.DB, nshards int, gen *IdGen) *Cluster {
-	if gen == nil {
-		gen = DefaultIdGen
+	return NewClusterWithOptions(dbs, nshards, &ClusterOptions{
+		IdGen: gen,
+	})
+}
+
+// NewClusterWithOptions returns new PostgreSQL cluster consisting of
+// physical dbs and running nshards logical shards configured with opt.
+func NewClusterWithOptions(dbs []*pg.DB, nshards int, opt *ClusterOptions) *Cluster {
+	if opt == nil {
+		opt = new(ClusterOptions)
 	}
+	opt.init()
+	gen := opt.IdGen
+
 	if len(dbs) == 0 {
 		panic("at least one db is required")
 	}
+	for i, db := range dbs {
+		if db == nil {
+			panic(fmt.Sprintf("sharding: dbs[%d] is nil", i))
+		}
+	}
 	if nshards == 0 {
 		panic("at least on shard is required")
 	}
-	if len(dbs) > gen.NumShards() || nshards > gen.NumShards() {
-		panic(fmt.Sprintf("too many shards"))
+	if nshards > gen.NumShards() {
+		panic(fmt.Sprintf(
+			"sharding: nshards=%d exceeds IdGen capacity %d", nshards, gen.NumShards()))
+	}
+	if len(dbs) > gen.NumShards() {
+		panic(fmt.Sprintf(
+			"sharding: len(dbs)=%d exceeds IdGen capacity %d", len(dbs), gen.NumShards()))
 	}
 	if nshards < len(dbs) {
 		panic("number of shards must be greater or equal number of dbs")
@@ -39,12 +280,43 @@ func NewClusterWithGen(dbs []*pg.DB, nshards int, gen *IdGen) *Cluster {
 	if nshards%len(dbs) != 0 {
 		panic("number of shards must be divideable by number of dbs")
 	}
+	checkParams(opt.Params)
+	checkRateLimits(opt.RateLimits)
+	if opt.Fallback != nil &&
+		(opt.Fallback.ShardId < 0 || opt.Fallback.ShardId >= int64(nshards)) {
+		panic(fmt.Sprintf(
+			"sharding: fallback shard %d is out of range of %d shards",
+			opt.Fallback.ShardId, nshards))
+	}
+	if opt.StablePlacement {
+		dbs = sortDBs(dbs)
+	}
 	cl := &Cluster{
-		gen:    gen,
-		dbs:    dbs,
-		shards: make([]*pg.DB, nshards),
+		opt:      opt,
+		gen:      gen,
+		dbs:      dbs,
+		shards:   make([]*pg.DB, nshards),
+		disabled: new(disabledState),
+		refs:     &refCount{n: 1},
+	}
+	if opt.SearchPath {
+		cl.searchPaths = newSearchPathPools(opt.ApplicationName)
 	}
+	cl.pools = newServerPools(opt)
 	cl.init()
+	if opt.AllowPartial {
+		cl.initUnreachable()
+	}
+	if opt.VerifyLayout {
+		if err := cl.VerifyLayout(); err != nil {
+			panic(err)
+		}
+	}
+	if opt.VerifySchemas {
+		if err := cl.VerifySchemas(context.Background()); err != nil {
+			panic(err)
+		}
+	}
 	return cl
 }
 
@@ -53,250 +325,941 @@ func NewCluster(dbs []*pg.DB, nshards int) *Cluster {
 }
 
 func (cl *Cluster) init() {
-	dbSet := make(map[*pg.DB]struct{})
+	cl.serverByKey = make(map[string]*pg.DB)
 	for _, db := range cl.dbs {
-		if _, ok := dbSet[db]; ok {
+		key := serverKey(db)
+		if _, ok := cl.serverByKey[key]; ok {
 			continue
 		}
-		dbSet[db] = struct{}{}
+		cl.serverByKey[key] = db
 		cl.servers = append(cl.servers, db)
 	}
+	// Servers are sorted, so operations over servers are reproducible
+	// regardless of order of the dbs.
+	sort.Slice(cl.servers, func(i, j int) bool {
+		a, b := cl.servers[i].Options(), cl.servers[j].Options()
+		if a.Addr != b.Addr {
+			return a.Addr < b.Addr
+		}
+		return serverKey(cl.servers[i]) < serverKey(cl.servers[j])
+	})
 
-	for i := 0; i < len(cl.shards); i++ {
-		cl.shards[i] = cl.newShard(cl.dbs[i%len(cl.dbs)], int64(i))
+	if cl.opt.CircuitBreaker != nil {
+		cl.breakers = make(map[*pg.DB]*circuitBreaker, len(cl.servers))
+		for _, db := range cl.servers {
+			cl.breakers[db] = newCircuitBreaker(cl.opt.CircuitBreaker)
+		}
 	}
+
+	cl.initRateLimits()
+	cl.initShards()
+}
+
+func (cl *Cluster) initShards() {
+	var placement []*pg.DB
+	if cl.opt.ConsistentHashing {
+		placement = ringPlacement(cl.dbs, len(cl.shards))
+	}
+	if placement == nil {
+		placement = make([]*pg.DB, len(cl.shards))
+		for i := range placement {
+			placement[i] = cl.dbs[i%len(cl.dbs)]
+		}
+	}
+	if cl.searchPaths != nil {
+		cl.searchPaths.init(placement)
+	}
+
+	cl.shardServers = make([]*pg.DB, len(cl.shards))
+	for i, db := range placement {
+		cl.shards[i] = cl.newShard(db, int64(i))
+		cl.shardServers[i] = cl.server(db)
+	}
+
+	cl.initReplicas()
+}
+
+// serverKey returns key that identifies the PostgreSQL server and the
+// database the db is connected to. Different *pg.DB connected to the same
+// server and database have the same key.
+func serverKey(db *pg.DB) string {
+	opt := db.Options()
+	return opt.Network + "://" + opt.User + "@" + opt.Addr + "/" + opt.Database
+}
+
+// sortDBs returns copy of the dbs sorted by server key.
+func sortDBs(dbs []*pg.DB) []*pg.DB {
+	sorted := make([]*pg.DB, len(dbs))
+	copy(sorted, dbs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return serverKey(sorted[i]) < serverKey(sorted[j])
+	})
+	return sorted
+}
+
+// server returns the cluster server that has the same identity as the db
+// or nil.
+func (cl *Cluster) server(db *pg.DB) *pg.DB {
+	if db == nil {
+		return nil
+	}
+	return cl.serverByKey[serverKey(db)]
+}
+
+// isClusterDB reports whether the db is one of the dbs
+// the cluster was created with.
+func (cl *Cluster) isClusterDB(db *pg.DB) bool {
+	for _, d := range cl.dbs {
+		if d == db {
+			return true
+		}
+	}
+	return false
 }
 
 func (cl *Cluster) newShard(db *pg.DB, id int64) *pg.DB {
+	if cl.pools != nil {
+		db = cl.pools.get(db, cl.isClusterDB(db), cl.limiters[cl.server(db)])
+	}
+	if cl.searchPaths != nil {
+		db = cl.searchPaths.get(db, id)
+	}
+	if cl.opt.DefaultTimeout > 0 {
+		db = db.WithTimeout(cl.opt.DefaultTimeout)
+	}
+	shard := cl.withShardParams(db, id)
+	if cl.opt.QueryLogger != nil {
+		cl.addQueryLogger(shard, id)
+	}
+	if cl.opt.Tracer != nil {
+		cl.addTracer(shard, id)
+	}
+	return shard
+}
+
+func (cl *Cluster) withShardParams(db *pg.DB, id int64) *pg.DB {
+	for param, value := range cl.opt.Params {
+		db = db.WithParam(param, value)
+	}
 	name := "shard" + strconv.FormatInt(id, 10)
 	return db.WithParam("shard_id", id).
-		WithParam("shard", types.F(name)).
+		WithParam("shard", ShardIdent(name)).
 		WithParam("epoch", cl.gen.epoch)
 }
 
+// ShardId returns id of the shard returned by the cluster. It is the
+// stable identity of the shard: methods such as Shard and WithContext
+// may return different *pg.DB for the same shard, so use the id
+// rather than the *pg.DB pointer as a map key.
+func ShardId(shard *pg.DB) int64 {
+	return shard.Param("shard_id").(int64)
+}
+
+// QuotedShardName returns the shard's schema name quoted as PostgreSQL
+// identifier, e.g. "shard3". It is the same value ?shard param is
+// substituted with and is safe to use in dynamically built SQL.
+func QuotedShardName(shard *pg.DB) string {
+	return string(shard.FormatQuery(nil, "?shard"))
+}
+
+// ShardIdent is a schema name that is always formatted as quoted
+// PostgreSQL identifier, so names that contain uppercase letters, are
+// reserved words or contain double quotes are safe to use in queries.
+// The ?shard param is a ShardIdent.
+type ShardIdent string
+
+var _ types.ValueAppender = ShardIdent("")
+
+func (name ShardIdent) AppendValue(b []byte, quote int) []byte {
+	return appendIdent(b, string(name))
+}
+
+// quoteIdent quotes the name as PostgreSQL identifier escaping
+// double quotes.
+func quoteIdent(name string) string {
+	return string(appendIdent(make([]byte, 0, len(name)+2), name))
+}
+
+func appendIdent(b []byte, name string) []byte {
+	b = append(b, '"')
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '"' {
+			b = append(b, '"', '"')
+		} else {
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
+
+func checkParams(params map[string]interface{}) {
+	for _, name := range []string{"shard_id", "shard", "epoch"} {
+		if _, ok := params[name]; ok {
+			panic(fmt.Sprintf("sharding: param %s is reserved", name))
+		}
+	}
+}
+
+// Close closes the dbs. If the cluster shares the dbs with clusters
+// created with Clone, the dbs are closed when the last of them is closed.
 func (cl *Cluster) Close() error {
-	var retErr error
-	for _, db := range cl.servers {
+	// Read-only pools are owned by the cluster that disabled the server
+	// rather than shared with clones.
+	disabledErr := cl.disabled.close()
+
+	if cl.refs != nil {
+		cl.refs.mu.Lock()
+		cl.refs.n--
+		n := cl.refs.n
+		cl.refs.mu.Unlock()
+		if n > 0 {
+			return disabledErr
+		}
+	}
+
+	retErr := disabledErr
+	closed := make(map[*pg.DB]struct{}, len(cl.dbs))
+	for _, db := range cl.dbs {
+		if _, ok := closed[db]; ok {
+			continue
+		}
+		closed[db] = struct{}{}
 		if err := db.Close(); err != nil && retErr == nil {
 			retErr = err
 		}
 	}
+	if cl.searchPaths != nil {
+		if err := cl.searchPaths.close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}
+	if cl.pools != nil {
+		if err := cl.pools.close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}
 	return retErr
 }
 
+// ShardByName returns the shard with the schema name, e.g. "shard42".
+// Quoted names are accepted too. It returns false if the name does not
+// match shard naming or the shard does not exist in the cluster.
+func (cl *Cluster) ShardByName(name string) (*pg.DB, bool) {
+	if len(name) >= 2 && name[0] == '"' && name[len(name)-1] == '"' {
+		name = name[1 : len(name)-1]
+	}
+	if !strings.HasPrefix(name, "shard") {
+		return nil, false
+	}
+	id, err := strconv.ParseInt(name[len("shard"):], 10, 64)
+	if err != nil || id < 0 || id >= int64(len(cl.shards)) {
+		return nil, false
+	}
+	if name != "shard"+strconv.FormatInt(id, 10) {
+		// Reject names like "shard01" or "shard+1".
+		return nil, false
+	}
+	return cl.route(id), true
+}
+
+// VerifyLayout checks that shard ids encoded in ids by IdGen map evenly
+// to the cluster shards, i.e. that the number of shards is a power of two
+// that does not exceed IdGen capacity. Otherwise SplitShard silently
+// routes ids to unexpected shards when IdGen or the number of shards
+// is changed.
+func (cl *Cluster) VerifyLayout() error {
+	nshards := len(cl.shards)
+	capacity := cl.gen.NumShards()
+	if nshards&(nshards-1) != 0 {
+		return fmt.Errorf("sharding: nshards=%d is not a power of two", nshards)
+	}
+	if nshards > capacity {
+		return fmt.Errorf(
+			"sharding: nshards=%d exceeds IdGen capacity %d", nshards, capacity)
+	}
+	return nil
+}
+
+// WithContext returns a copy of the cluster which shards use the ctx
+// for all queries. ForEach* methods of the returned cluster stop
+// processing remaining shards when the ctx is done. The copy shares
+// servers and state (e.g. disabled servers) with the original cluster.
+func (cl *Cluster) WithContext(ctx context.Context) *Cluster {
+	clone := *cl
+	clone.ctx = ctx
+	clone.shards = withContext(cl.shards, ctx)
+	clone.replicaShards = withContext(cl.replicaShards, ctx)
+	return &clone
+}
+
+// WithIdGen returns a copy of the cluster that uses the gen, e.g. after
+// the IdGen epoch is changed during a migration. Shards are recreated
+// with ?epoch param of the gen, but share connections with the original
+// cluster, so closing either cluster closes both. The gen must support
+// the number of shards in the cluster. Servers disabled with
+// DisableServer are enabled in the copy.
+func (cl *Cluster) WithIdGen(gen *IdGen) *Cluster {
+	if len(cl.shards) > gen.NumShards() {
+		panic(fmt.Sprintf(
+			"sharding: nshards=%d exceeds IdGen capacity %d", len(cl.shards), gen.NumShards()))
+	}
+
+	opt := *cl.opt
+	opt.IdGen = gen
+
+	clone := *cl
+	clone.opt = &opt
+	clone.gen = gen
+	clone.shards = make([]*pg.DB, len(cl.shards))
+	clone.disabled = new(disabledState)
+	clone.initShards()
+	if clone.ctx != nil {
+		clone.shards = withContext(clone.shards, clone.ctx)
+		clone.replicaShards = withContext(clone.replicaShards, clone.ctx)
+	}
+	return &clone
+}
+
+// Clone returns a copy of the cluster with shards recreated with the
+// params set in addition to ClusterOptions.Params, e.g. to use different
+// application_name for read and write workloads. The copy shares
+// connection pools with the cluster, but unlike copies returned by
+// WithContext and WithIdGen it can be closed independently: pools are
+// closed when both the cluster and all its clones are closed. Servers
+// disabled with DisableServer are enabled in the copy.
+func (cl *Cluster) Clone(params map[string]interface{}) *Cluster {
+	checkParams(params)
+
+	opt := *cl.opt
+	opt.Params = make(map[string]interface{}, len(cl.opt.Params)+len(params))
+	for name, value := range cl.opt.Params {
+		opt.Params[name] = value
+	}
+	for name, value := range params {
+		opt.Params[name] = value
+	}
+
+	clone := *cl
+	clone.opt = &opt
+	clone.shards = make([]*pg.DB, len(cl.shards))
+	clone.disabled = new(disabledState)
+	clone.initShards()
+	if clone.ctx != nil {
+		clone.shards = withContext(clone.shards, clone.ctx)
+		clone.replicaShards = withContext(clone.replicaShards, clone.ctx)
+	}
+
+	if cl.refs != nil {
+		cl.refs.mu.Lock()
+		cl.refs.n++
+		cl.refs.mu.Unlock()
+	}
+	return &clone
+}
+
+func withContext(shards []*pg.DB, ctx context.Context) []*pg.DB {
+	if shards == nil {
+		return nil
+	}
+	ctxShards := make([]*pg.DB, len(shards))
+	for i, shard := range shards {
+		if shard != nil {
+			ctxShards[i] = shard.WithContext(ctx)
+		}
+	}
+	return ctxShards
+}
+
+// Context returns the cluster context set with WithContext.
+func (cl *Cluster) Context() context.Context {
+	if cl.ctx != nil {
+		return cl.ctx
+	}
+	return context.Background()
+}
+
 // DBs returns list of database servers in the cluster.
 func (cl *Cluster) DBs() []*pg.DB {
 	return cl.dbs
 }
 
+// Servers returns distinct servers in the cluster sorted by address.
+// Unlike DBs every server is listed once and the order does not depend
+// on order of the dbs passed to the constructor. ForEachDB and other
+// methods that operate on servers start processing them in this order.
+func (cl *Cluster) Servers() []*pg.DB {
+	servers := make([]*pg.DB, len(cl.servers))
+	copy(servers, cl.servers)
+	return servers
+}
+
+// String returns a summary of the cluster topology, e.g.
+// "Cluster<4 shards, 2 servers, 2 shards per server>".
+func (cl *Cluster) String() string {
+	minShards, maxShards := len(cl.shards), 0
+	for _, n := range cl.ShardCountPerServer() {
+		if n < minShards {
+			minShards = n
+		}
+		if n > maxShards {
+			maxShards = n
+		}
+	}
+	perServer := strconv.Itoa(maxShards)
+	if minShards != maxShards {
+		perServer = strconv.Itoa(minShards) + "-" + perServer
+	}
+	return fmt.Sprintf("Cluster<%d shards, %d servers, %s shards per server>",
+		len(cl.shards), len(cl.servers), perServer)
+}
+
+// Describe returns placement of shards on servers with a line per server
+// that contains server address, database and ranges of shard ids placed
+// on the server, e.g. "db1:5432/app: shards 0-3, 8-11". Servers disabled
+// with DisableServer are marked as disabled.
+func (cl *Cluster) Describe() string {
+	disabled := cl.loadDisabled()
+	var b strings.Builder
+	for _, server := range cl.servers {
+		opt := server.Options()
+		b.WriteString(opt.Addr)
+		if opt.Database != "" {
+			b.WriteByte('/')
+			b.WriteString(opt.Database)
+		}
+		b.WriteString(": shards")
+
+		start := int64(-1)
+		var prev int64
+		var n int
+		writeRange := func() {
+			if n > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatInt(start, 10))
+			if prev != start {
+				b.WriteByte('-')
+				b.WriteString(strconv.FormatInt(prev, 10))
+			}
+			n++
+		}
+		for i, shardServer := range cl.shardServers {
+			if shardServer != server {
+				continue
+			}
+			id := int64(i)
+			if start != -1 && id != prev+1 {
+				writeRange()
+				start = -1
+			}
+			if start == -1 {
+				start = id
+			}
+			prev = id
+		}
+		if start != -1 {
+			writeRange()
+		}
+
+		if _, ok := disabled.servers[server]; ok {
+			b.WriteString(" (disabled)")
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
 // DB maps the number to the corresponding database server.
+// It returns nil if the cluster has no shards.
 func (cl *Cluster) DB(number int64) *pg.DB {
+	if len(cl.shards) == 0 {
+		return nil
+	}
 	number = number % int64(len(cl.shards))
+	if cl.opt.ConsistentHashing {
+		return cl.shardServers[number]
+	}
 	number = number % int64(len(cl.dbs))
 	return cl.dbs[number]
 }
 
 // Shards returns list of shards running in the db. If db is nil all
-// shards are returned.
+// shards are returned. Servers are matched by network, address, user
+// and database rather than by *pg.DB identity.
 func (cl *Cluster) Shards(db *pg.DB) []*pg.DB {
 	if db == nil {
 		return cl.shards
 	}
+	server := cl.server(db)
+	if server == nil {
+		return nil
+	}
 	var shards []*pg.DB
 	for i, shard := range cl.shards {
-		if cl.dbs[i%len(cl.dbs)] == db {
+		if cl.shardServers[i] == server {
 			shards = append(shards, shard)
 		}
 	}
 	return shards
 }
 
+// ShardsForServerName returns shards placed on servers which
+// pg.Options.Addr is the addr. The addr may be specified without port,
+// e.g. a hostname from an alert, in which case servers on any port of
+// the host match. Shards of all databases on matching servers are
+// returned in shard id order.
+func (cl *Cluster) ShardsForServerName(addr string) []*pg.DB {
+	var shards []*pg.DB
+	for i, shard := range cl.shards {
+		if serverAddrMatches(cl.shardServers[i].Options().Addr, addr) {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+func serverAddrMatches(serverAddr, addr string) bool {
+	if serverAddr == addr {
+		return true
+	}
+	host, _, err := net.SplitHostPort(serverAddr)
+	return err == nil && host == addr
+}
+
+// ShardCountPerServer returns number of shards placed on each server.
+// Servers are deduplicated by network, address, user and database, so
+// the map is keyed by the first *pg.DB passed for each server.
+func (cl *Cluster) ShardCountPerServer() map[*pg.DB]int {
+	m := make(map[*pg.DB]int, len(cl.servers))
+	for _, server := range cl.shardServers {
+		m[server]++
+	}
+	return m
+}
+
+// ShardPlacement describes where the shard is placed.
+type ShardPlacement struct {
+	ShardId int64
+	// Schema is the unquoted name of the shard's schema, e.g. shard3.
+	Schema string
+	// Server is the first db passed to the cluster constructor
+	// for the server that hosts the shard.
+	Server *pg.DB
+}
+
+// Topology returns placement of every shard in the cluster ordered by
+// shard id.
+func (cl *Cluster) Topology() []ShardPlacement {
+	return topology(cl.shards, cl.shardServers)
+}
+
+func topology(shards, shardServers []*pg.DB) []ShardPlacement {
+	placements := make([]ShardPlacement, len(shards))
+	for i, shard := range shards {
+		id := ShardId(shard)
+		placements[i] = ShardPlacement{
+			ShardId: id,
+			Schema:  "shard" + strconv.FormatInt(id, 10),
+			Server:  shardServers[i],
+		}
+	}
+	return placements
+}
+
 // Shard maps the number to the corresponding shard in the cluster.
+// Negative numbers wrap around like numbers out of range of the cluster.
+// It returns nil if the cluster has no shards.
 func (cl *Cluster) Shard(number int64) *pg.DB {
-	number = number % int64(len(cl.shards))
-	return cl.shards[number]
+	i, ok := cl.shardIndex(number)
+	if !ok {
+		return nil
+	}
+	return cl.route(i)
+}
+
+// shardIndex maps the number to index of the shard in the cluster.
+// It returns false if the cluster has no shards.
+func (cl *Cluster) shardIndex(number int64) (int64, bool) {
+	n := int64(len(cl.shards))
+	if n == 0 {
+		return 0, false
+	}
+	if number >= n || number < 0 {
+		number = number % n
+		if number < 0 {
+			number += n
+		}
+	}
+	return number, true
 }
 
 // SplitShard uses SplitId to extract shard id from the id and then
-// returns corresponding Shard in the cluster.
+// returns corresponding Shard in the cluster. ClusterOptions.RouteOverride
+// is consulted first and ClusterOptions.Fallback is used for ids that
+// can't be resolved. It returns nil if the cluster has no shards.
 func (cl *Cluster) SplitShard(id int64) *pg.DB {
-	_, shardId, _ := cl.gen.SplitId(id)
-	return cl.Shard(shardId)
+	if len(cl.shards) == 0 {
+		return nil
+	}
+	return cl.Shard(cl.splitShardId(id))
 }
 
-// ForEachDB concurrently calls the fn on each database in the cluster.
-func (cl *Cluster) ForEachDB(fn func(db *pg.DB) error) error {
-	errCh := make(chan error, 1)
-	var wg sync.WaitGroup
-	wg.Add(len(cl.servers))
-	for _, db := range cl.servers {
-		go func(db *pg.DB) {
-			defer wg.Done()
-			if err := fn(db); err != nil {
-				select {
-				case errCh <- err:
-				default:
-				}
-			}
-		}(db)
+// ShardForIdString parses the decimal id, e.g. received as a JSON string,
+// and routes it to the shard with SplitShard.
+func (cl *Cluster) ShardForIdString(s string) (*pg.DB, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("sharding: invalid id %q", s)
+	}
+	return cl.SplitShard(id), nil
+}
+
+// TxOnShardForId routes the id to the shard with SplitShard and runs
+// the fn in a transaction on the shard with RunInTransactionContext.
+// The transaction is committed if the fn returns nil and rolled back if
+// the fn returns an error or panics. It returns ErrNoShards if the
+// cluster has no shards.
+func (cl *Cluster) TxOnShardForId(ctx context.Context, id int64, fn func(tx *pg.Tx) error) error {
+	if fn == nil {
+		panic("sharding: TxOnShardForId is called with nil fn")
+	}
+	shard := cl.SplitShard(id)
+	if shard == nil {
+		return ErrNoShards
+	}
+	return RunInTransactionContext(ctx, shard, fn)
+}
+
+// QueryShard routes the id to the shard with SplitShard and runs the
+// query on the shard decoding rows into the model like pg.DB.Query.
+// It returns ErrNoShards if the cluster has no shards.
+func (cl *Cluster) QueryShard(
+	id int64, model interface{}, query interface{}, params ...interface{},
+) (orm.Result, error) {
+	shard := cl.SplitShard(id)
+	if shard == nil {
+		return nil, ErrNoShards
+	}
+	return shard.Query(model, query, params...)
+}
+
+func (cl *Cluster) splitShardId(id int64) int64 {
+	if cl.opt.RouteOverride != nil {
+		if shardId, ok := cl.opt.RouteOverride(id); ok {
+			return shardId
+		}
+	}
+	shardId := cl.gen.shardId(id)
+	if fb := cl.opt.Fallback; fb != nil && (id < 0 || shardId >= int64(len(cl.shards))) {
+		if fb.OnFallback != nil {
+			fb.OnFallback(id, shardId)
+		}
+		return fb.ShardId
 	}
-	wg.Wait()
+	return shardId
+}
+
+// GroupByShard groups the ids by id of the shard SplitShard routes them
+// to. Order of ids within a group is preserved.
+func (cl *Cluster) GroupByShard(ids []int64) map[int64][]int64 {
+	groups := make(map[int64][]int64)
+	for _, id := range ids {
+		shardId := cl.splitShardId(id) % int64(len(cl.shards))
+		groups[shardId] = append(groups[shardId], id)
+	}
+	return groups
+}
+
+// SplitShardBatch resolves shards of the ids like SplitShard, but
+// instead of wrapping shard ids that are out of range it reports an error
+// for each invalid id unless ClusterOptions.Fallback is set. Returned
+// slices are aligned with the ids: each slot contains either the shard or
+// the error for the id.
+func (cl *Cluster) SplitShardBatch(ids []int64) ([]*pg.DB, []error) {
+	shards := make([]*pg.DB, len(ids))
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		if id < 0 && cl.opt.Fallback == nil {
+			errs[i] = fmt.Errorf("sharding: id %d is negative", id)
+			continue
+		}
+		shardId := cl.splitShardId(id)
+		if shardId < 0 || shardId >= int64(len(cl.shards)) {
+			errs[i] = fmt.Errorf(
+				"sharding: id %d has shard %d, cluster has %d shards",
+				id, shardId, len(cl.shards))
+			continue
+		}
+		shards[i] = cl.route(shardId)
+	}
+	return shards, errs
+}
+
+// ShardForKey hashes the key using ClusterOptions.Hash and returns
+// corresponding Shard in the cluster. It is useful for entities that are
+// routed by a string key (e.g. email) rather than by an IdGen id.
+func (cl *Cluster) ShardForKey(key string) *pg.DB {
+	return cl.ShardForBytes([]byte(key))
+}
 
-	select {
-	case err := <-errCh:
-		return err
-	default:
+// ShardForBytes is like ShardForKey, but accepts binary key, e.g.
+// composite key built with CompositeKey.
+func (cl *Cluster) ShardForBytes(key []byte) *pg.DB {
+	nshards := uint64(len(cl.shards))
+	if nshards == 0 {
 		return nil
 	}
+	return cl.route(int64(cl.opt.Hash(key) % nshards))
 }
 
-// ForEachShard concurrently calls the fn on each shard in the cluster.
-// It is the same as ForEachNShards(1, fn).
-func (cl *Cluster) ForEachShard(fn func(shard *pg.DB) error) error {
-	return cl.ForEachDB(func(db *pg.DB) error {
-		var firstErr error
-		for _, shard := range cl.shards {
-			if shard.Options() != db.Options() {
-				continue
-			}
+// CompositeKey encodes the parts of a composite sharding key, e.g.
+// tenant id and region, into a key for ShardForBytes. Parts are formatted
+// with fmt.Sprint and prefixed with their length, so different
+// combinations of parts never produce the same key, e.g. ("ab", "c") and
+// ("a", "bc").
+func CompositeKey(parts ...interface{}) []byte {
+	var b []byte
+	for _, part := range parts {
+		s := fmt.Sprint(part)
+		b = strconv.AppendInt(b, int64(len(s)), 10)
+		b = append(b, ':')
+		b = append(b, s...)
+	}
+	return b
+}
 
-			if err := fn(shard); err != nil && firstErr == nil {
-				firstErr = err
-			}
+// ShardForTime maps the timestamp to a bucket using
+// ClusterOptions.TimeBucket and returns corresponding Shard in the
+// cluster, i.e. buckets are assigned to shards round-robin. It is useful
+// for time-series data that is sharded by creation time rather than
+// by id.
+func (cl *Cluster) ShardForTime(t time.Time) *pg.DB {
+	return cl.Shard(cl.opt.TimeBucket(t))
+}
+
+// ForEachDB concurrently calls the fn on each database in the cluster.
+// Servers disabled with DisableServer are skipped unless WithDisabled
+// option is used. On a cluster returned by WithContext the db passed to
+// the fn is bound to the context, so it is not equal to the server
+// returned by Servers; compare servers by options instead.
+func (cl *Cluster) ForEachDB(fn func(db *pg.DB) error, opts ...ForEachOption) error {
+	if fn == nil {
+		panic("sharding: ForEachDB is called with nil fn")
+	}
+	return cl.forEachDB(func(db *pg.DB) error {
+		if cl.isUnreachable(db) {
+			return ErrServerUnreachable
 		}
-		return firstErr
-	})
+		return cl.withBreaker(db, func() error {
+			if cl.ctx != nil {
+				return wrapPoolTimeout(fn(db.WithContext(cl.ctx)))
+			}
+			return wrapPoolTimeout(fn(db))
+		})
+	}, newForEachOptions(opts))
+}
+
+// ForEachShard concurrently calls the fn on each shard in the cluster.
+// Shards on different servers are processed concurrently and shards on
+// the same server are processed one by one unless WithConcurrency option
+// is used.
+func (cl *Cluster) ForEachShard(fn func(shard *pg.DB) error, opts ...ForEachOption) error {
+	if fn == nil {
+		panic("sharding: ForEachShard is called with nil fn")
+	}
+	return cl.forEachShard(cl.shards, cl.shardServers, fn, newForEachOptions(opts))
+}
+
+// ForEachShardWithID is like ForEachShard, but also passes id of the
+// shard to the fn.
+func (cl *Cluster) ForEachShardWithID(
+	fn func(shardId int64, shard *pg.DB) error, opts ...ForEachOption,
+) error {
+	if fn == nil {
+		panic("sharding: ForEachShardWithID is called with nil fn")
+	}
+	return cl.ForEachShard(func(shard *pg.DB) error {
+		return fn(ShardId(shard), shard)
+	}, opts...)
 }
 
 // ForEachNShards concurrently calls the fn on each N shards in the cluster.
-func (cl *Cluster) ForEachNShards(n int, fn func(shard *pg.DB) error) error {
-	return cl.ForEachDB(func(db *pg.DB) error {
-		var wg sync.WaitGroup
-		errCh := make(chan error, 1)
-		limit := make(chan struct{}, n)
-
-		for _, shard := range cl.shards {
-			if shard.Options() != db.Options() {
-				continue
-			}
+// It is the same as ForEachShard(fn, WithConcurrency(n)).
+func (cl *Cluster) ForEachNShards(
+	n int, fn func(shard *pg.DB) error, opts ...ForEachOption,
+) error {
+	if fn == nil {
+		panic("sharding: ForEachNShards is called with nil fn")
+	}
+	return cl.ForEachShard(fn, append(opts[:len(opts):len(opts)], WithConcurrency(n))...)
+}
 
-			limit <- struct{}{}
-			wg.Add(1)
-			go func(shard *pg.DB) {
-				defer func() {
-					<-limit
-					wg.Done()
-				}()
-				if err := fn(shard); err != nil {
-					select {
-					case errCh <- err:
-					default:
-					}
-				}
-			}(shard)
-		}
-
-		wg.Wait()
-
-		select {
-		case err := <-errCh:
+// ForEachShardInServerOrder calls the fn on each shard in the cluster
+// processing shards on the same server strictly one at a time in shard
+// id order, while servers are processed concurrently. The next shard on
+// a server is started only after the fn returned for the previous one,
+// including retries. It is useful for IO heavy sweeps such as VACUUM.
+// WithConcurrency option is ignored.
+func (cl *Cluster) ForEachShardInServerOrder(
+	fn func(shard *pg.DB) error, opts ...ForEachOption,
+) error {
+	if fn == nil {
+		panic("sharding: ForEachShardInServerOrder is called with nil fn")
+	}
+	return cl.ForEachShard(fn, append(opts[:len(opts):len(opts)], WithConcurrency(1))...)
+}
+
+// ForEachShardWeighted is like ForEachShard, but starts shards with
+// bigger weight first on each server (longest processing time first), so
+// big shards do not become stragglers at the end of the run. Shards with
+// equal weight are started in shard id order.
+func (cl *Cluster) ForEachShardWeighted(
+	weight func(shardId int64) int, fn func(shard *pg.DB) error, opts ...ForEachOption,
+) error {
+	if fn == nil {
+		panic("sharding: ForEachShardWeighted is called with nil fn")
+	}
+
+	weights := make([]int, len(cl.shards))
+	order := make([]int, len(cl.shards))
+	for i := range cl.shards {
+		weights[i] = weight(int64(i))
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return weights[order[i]] > weights[order[j]]
+	})
+
+	shards := make([]*pg.DB, len(order))
+	shardServers := make([]*pg.DB, len(order))
+	for i, ind := range order {
+		shards[i] = cl.shards[ind]
+		shardServers[i] = cl.shardServers[ind]
+	}
+	return cl.forEachShard(shards, shardServers, fn, newForEachOptions(opts))
+}
+
+// ForEachShardUntil concurrently calls the fn on each shard in the
+// cluster until the fn reports that it is done, e.g. because the record
+// being searched for is found on the shard. Shards that are not started
+// yet are skipped after that and the matched shard is returned. It
+// returns nil shard if no shard matched. Errors are handled as in
+// ForEachShard.
+func (cl *Cluster) ForEachShardUntil(
+	fn func(shard *pg.DB) (done bool, err error), opts ...ForEachOption,
+) (*pg.DB, error) {
+	if fn == nil {
+		panic("sharding: ForEachShardUntil is called with nil fn")
+	}
+
+	opt := newForEachOptions(opts)
+	ctx, cancel := context.WithCancel(opt.ctx)
+	defer cancel()
+	opt.ctx = ctx
+
+	var mu sync.Mutex
+	var found *pg.DB
+	err := cl.forEachShard(cl.shards, cl.shardServers, func(shard *pg.DB) error {
+		done, err := fn(shard)
+		if err != nil {
 			return err
-		default:
-			return nil
 		}
-	})
+		if done {
+			mu.Lock()
+			if found == nil {
+				found = shard
+			}
+			mu.Unlock()
+			cancel()
+		}
+		return nil
+	}, opt)
+	if found != nil {
+		return found, nil
+	}
+	return nil, err
 }
 
 // SubCluster is a subset of the cluster.
 type SubCluster struct {
-	cl     *Cluster
-	shards []*pg.DB
+	cl           *Cluster
+	offset       int
+	shards       []*pg.DB
+	shardServers []*pg.DB
 }
 
 // SubCluster returns a subset of the cluster of the given size.
+// The size is clamped to [1, number of shards in the cluster].
 func (cl *Cluster) SubCluster(number int64, size int) *SubCluster {
 	if size > len(cl.shards) {
 		size = len(cl.shards)
 	}
+	if size < 1 {
+		size = 1
+	}
 	step := len(cl.shards) / size
 	clusterId := int(number%int64(step)) * size
 	shards := make([]*pg.DB, size)
+	shardServers := make([]*pg.DB, size)
 	for i := 0; i < size; i++ {
 		shards[i] = cl.shards[clusterId+i]
+		shardServers[i] = cl.shardServers[clusterId+i]
 	}
 
 	return &SubCluster{
-		cl:     cl,
-		shards: shards,
+		cl:           cl,
+		offset:       clusterId,
+		shards:       shards,
+		shardServers: shardServers,
 	}
 }
 
+// Topology returns placement of every shard in the subcluster ordered
+// by shard id.
+func (cl *SubCluster) Topology() []ShardPlacement {
+	return topology(cl.shards, cl.shardServers)
+}
+
 // SplitShard uses SplitId to extract shard id from the id and then
-// returns corresponding Shard in the subcluster.
+// returns corresponding Shard in the subcluster. It returns nil if the
+// subcluster has no shards.
 func (cl *SubCluster) SplitShard(id int64) *pg.DB {
-	_, shardId, _ := cl.cl.gen.SplitId(id)
-	return cl.Shard(shardId)
+	if len(cl.shards) == 0 {
+		return nil
+	}
+	return cl.Shard(cl.cl.gen.shardId(id))
 }
 
 // Shard maps the number to the corresponding shard in the subscluster.
+// It returns nil if the subcluster has no shards.
 func (cl *SubCluster) Shard(number int64) *pg.DB {
+	if len(cl.shards) == 0 {
+		return nil
+	}
 	number = number % int64(len(cl.shards))
-	return cl.shards[number]
+	return cl.cl.route(int64(cl.offset) + number)
 }
 
 // ForEachShard concurrently calls the fn on each shard in the subcluster.
-// It is the same as ForEachNShards(1, fn).
-func (cl *SubCluster) ForEachShard(fn func(shard *pg.DB) error) error {
-	return cl.cl.ForEachDB(func(db *pg.DB) error {
-		var firstErr error
-		for _, shard := range cl.shards {
-			if shard.Options() != db.Options() {
-				continue
-			}
-
-			if err := fn(shard); err != nil && firstErr == nil {
-				firstErr = err
-			}
-		}
-		return firstErr
-	})
+// Shards on different servers are processed concurrently and shards on
+// the same server are processed one by one unless WithConcurrency option
+// is used.
+func (cl *SubCluster) ForEachShard(fn func(shard *pg.DB) error, opts ...ForEachOption) error {
+	if fn == nil {
+		panic("sharding: ForEachShard is called with nil fn")
+	}
+	return cl.cl.forEachShard(cl.shards, cl.shardServers, fn, newForEachOptions(opts))
 }
 
 // ForEachNShards concurrently calls the fn on each N shards in the subcluster.
-func (cl *SubCluster) ForEachNShards(n int, fn func(shard *pg.DB) error) error {
-	return cl.cl.ForEachDB(func(db *pg.DB) error {
-		var wg sync.WaitGroup
-		errCh := make(chan error, 1)
-		limit := make(chan struct{}, n)
-
-		for _, shard := range cl.shards {
-			if shard.Options() != db.Options() {
-				continue
-			}
-
-			limit <- struct{}{}
-			wg.Add(1)
-			go func(shard *pg.DB) {
-				defer func() {
-					<-limit
-					wg.Done()
-				}()
-				if err := fn(shard); err != nil {
-					select {
-					case errCh <- err:
-					default:
-					}
-				}
-			}(shard)
-		}
-
-		wg.Wait()
-
-		select {
-		case err := <-errCh:
-			return err
-		default:
-			return nil
-		}
-	})
+// It is the same as ForEachShard(fn, WithConcurrency(n)).
+func (cl *SubCluster) ForEachNShards(
+	n int, fn func(shard *pg.DB) error, opts ...ForEachOption,
+) error {
+	if fn == nil {
+		panic("sharding: ForEachNShards is called with nil fn")
+	}
+	return cl.ForEachShard(fn, append(opts[:len(opts):len(opts)], WithConcurrency(n))...)
 }
@@ -1,11 +1,21 @@
 package sharding_test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -21,7 +31,7 @@ func TestGinkgo(t *testing.T) {
 	RunSpecs(t, "sharding")
 }
 
-var _ = Describe("named params", func() {
+var _ = Describe("postgres", func() {
 	var cluster *sharding.Cluster
 
 	BeforeEach(func() {
@@ -29,212 +39,3268 @@ var _ = Describe("named params", func() {
 			User: "postgres",
 		})
 		cluster = sharding.NewCluster([]*pg.DB{db}, 4)
+		dropShardSchemas(cluster)
 	})
 
-	It("supports ?shard", func() {
-		var shardName, hello string
-		_, err := cluster.Shard(3).QueryOne(
-			pg.Scan(&shardName, &hello), `SELECT '?shard', ?`, "hello")
+	AfterEach(func() {
+		Expect(cluster.Close()).NotTo(HaveOccurred())
+	})
+
+	Describe("named params", func() {
+		It("supports ?shard", func() {
+			var shardName, hello string
+			_, err := cluster.Shard(3).QueryOne(
+				pg.Scan(&shardName, &hello), `SELECT '?shard', ?`, "hello")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shardName).To(Equal(`"shard3"`))
+			Expect(hello).To(Equal("hello"))
+		})
+
+		It("supports ?shard_id", func() {
+			var shardId int
+			_, err := cluster.Shard(3).QueryOne(pg.Scan(&shardId), "SELECT ?shard_id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shardId).To(Equal(3))
+		})
+
+		It("supports ?epoch", func() {
+			var epoch int64
+			_, err := cluster.Shard(0).QueryOne(pg.Scan(&epoch), "SELECT ?epoch")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(epoch).To(Equal(int64(1262304000000)))
+		})
+
+		It("supports params in prepared statements", func() {
+			stmt, err := sharding.PrepareShard(cluster.Shard(3), `SELECT '?shard', ?shard_id, $1::text`)
+			Expect(err).NotTo(HaveOccurred())
+			defer stmt.Close()
+
+			var shardName, hello string
+			var shardId int
+			_, err = stmt.QueryOne(pg.Scan(&shardName, &shardId, &hello), "hello")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shardName).To(Equal(`"shard3"`))
+			Expect(shardId).To(Equal(3))
+			Expect(hello).To(Equal("hello"))
+		})
+
+		It("formats shard params into reused buffer without allocations", func() {
+			shard := cluster.Shard(3)
+			b := make([]byte, 0, 128)
+			allocs := testing.AllocsPerRun(100, func() {
+				b = shard.FormatQuery(b[:0], `SELECT * FROM ?shard.users WHERE id = ?shard_id`)
+			})
+			Expect(string(b)).To(Equal(`SELECT * FROM "shard3".users WHERE id = 3`))
+			Expect(allocs).To(BeZero())
+		})
+
+		It("supports UUID", func() {
+			src := sharding.NewUUID(1234, time.Unix(math.MaxInt64, 0))
+			var dst sharding.UUID
+			_, err := cluster.Shard(3).QueryOne(pg.Scan(&dst), `SELECT ?`, src)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dst).To(Equal(src))
+		})
+	})
+
+	Describe("QueryInto", func() {
+		It("queries typed rows with QueryInto", func() {
+			type row struct {
+				N       int
+				ShardId int64
+			}
+			rows, err := sharding.QueryInto[row](cluster.Shard(2),
+				`SELECT n, ?shard_id AS shard_id FROM generate_series(1, ?) n`, 3)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rows).To(Equal([]row{{1, 2}, {2, 2}, {3, 2}}))
+		})
+	})
+
+	Describe("QueryShard", func() {
+		It("routes reads by id with QueryShard", func() {
+			id := sharding.DefaultIdGen.NextId(time.Now(), 2, 1)
+			var ids []int64
+			_, err := cluster.QueryShard(id, &ids, `SELECT ?shard_id UNION ALL SELECT ?`, id)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]int64{2, id}))
+		})
+	})
+
+	Describe("ExecResult", func() {
+		It("returns executed statement with ExecResult", func() {
+			res, q, err := sharding.ExecResult(cluster.Shard(3), `SELECT ?shard_id, ?`, "a?b")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(q).To(Equal(`SELECT 3, 'a?b'`))
+			Expect(res.RowsReturned()).To(Equal(1))
+		})
+	})
+
+	Describe("QueryScalar", func() {
+		It("queries single value with QueryScalar", func() {
+			shard := cluster.Shard(3)
+
+			var n int64
+			err := sharding.QueryScalar(shard, &n, `SELECT max(n) * ?shard_id FROM generate_series(1, ?) n`, 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int64(6)))
+
+			err = sharding.QueryScalar(shard, &n, `SELECT 1 WHERE false`)
+			Expect(err).To(Equal(pg.ErrNoRows))
+
+			err = sharding.QueryScalar(shard, &n, `SELECT generate_series(1, 2)`)
+			Expect(err).To(Equal(pg.ErrMultiRows))
+
+			err = sharding.QueryScalar(shard, &n, `SELECT 1, 2`)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ExecInt", func() {
+		It("returns affected rows with ExecInt", func() {
+			n, err := sharding.ExecInt(cluster.Shard(3), `SELECT generate_series(1, ?shard_id)`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(3))
+		})
+	})
+
+	Describe("RunInTransactionContext", func() {
+		It("cancels transaction when context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			err := sharding.RunInTransactionContext(ctx, cluster.Shard(3), func(tx *pg.Tx) error {
+				_, err := tx.Exec(`SELECT pg_sleep(10)`)
+				return err
+			})
+			Expect(err).To(Equal(context.DeadlineExceeded))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+			err = sharding.RunInTransactionContext(context.Background(), cluster.Shard(3), func(tx *pg.Tx) error {
+				_, err := tx.Exec(`SELECT 1`)
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("cancels transaction started with BeginContext", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			tx, err := sharding.BeginContext(ctx, cluster.Shard(3))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tx.Context()).To(Equal(ctx))
+
+			start := time.Now()
+			_, err = tx.Exec(`SELECT pg_sleep(10)`)
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			Expect(tx.Commit()).To(Equal(context.DeadlineExceeded))
+
+			tx, err = sharding.BeginContext(context.Background(), cluster.Shard(3))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = tx.Exec(`SELECT 1`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tx.Commit()).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("RunInTx", func() {
+		It("runs fn in transaction with RunInTx", func() {
+			shard := cluster.Shard(3)
+			err := sharding.RunInTx(shard, func(tx *pg.Tx) error {
+				_, err := tx.Exec(`SELECT 1`)
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = sharding.RunInTx(shard, func(tx *pg.Tx) error {
+				return errors.New("fake error")
+			})
+			Expect(err).To(MatchError("fake error"))
+
+			Expect(recovered(func() {
+				_ = sharding.RunInTx(shard, func(tx *pg.Tx) error {
+					panic("fake panic")
+				})
+			})).To(Equal("fake panic"))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err = sharding.RunInTx(shard.WithContext(ctx), func(tx *pg.Tx) error {
+				return nil
+			})
+			Expect(err).To(Equal(context.Canceled))
+		})
+	})
+
+	Describe("AllowPartial", func() {
+		It("skips unreachable servers with AllowPartial", func() {
+			db := pg.Connect(&pg.Options{
+				User: "postgres",
+			})
+			down := pg.Connect(&pg.Options{
+				Addr: "localhost:1",
+			})
+			cl := sharding.NewClusterWithOptions([]*pg.DB{db, down}, 4, &sharding.ClusterOptions{
+				AllowPartial: true,
+			})
+			defer cl.Close()
+			Expect(cl.UnreachableServers()).To(HaveKey(down))
+
+			outcomes := cl.ForEachShardResult(func(shard *pg.DB) error {
+				_, err := shard.Exec(`SELECT 1`)
+				return err
+			})
+			Expect(outcomes).To(HaveLen(4))
+			Expect(outcomes[0].Err).NotTo(HaveOccurred())
+			Expect(outcomes[1].Err).To(Equal(sharding.ErrServerUnreachable))
+		})
+	})
+
+	Describe("ForEachShardWithConnection", func() {
+		It("keeps session state in ForEachShardWithConnection", func() {
+			err := cluster.ForEachShardWithConnection(func(shard *sharding.PinnedShard) error {
+				_, err := shard.Exec(`SELECT set_config('sharding.test', ?shard_id::text, false)`)
+				if err != nil {
+					return err
+				}
+
+				var got int64
+				_, err = shard.QueryOne(pg.Scan(&got), `SELECT current_setting('sharding.test')::int`)
+				if err != nil {
+					return err
+				}
+				Expect(got).To(Equal(shard.ShardId()))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("WithReconnect", func() {
+		It("retries shards after reconnect", func() {
+			var mu sync.Mutex
+			failed := make(map[int64]bool)
+			stats := new(sharding.ReconnectStats)
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if !failed[shardId(shard)] {
+					failed[shardId(shard)] = true
+					return io.EOF
+				}
+				return nil
+			}, sharding.WithReconnect(3, sharding.ConstantBackoff(time.Millisecond), stats))
+			Expect(err).NotTo(HaveOccurred())
+
+			var retries int
+			for _, n := range stats.Retries() {
+				retries += n
+			}
+			Expect(retries).To(Equal(len(failed)))
+		})
+	})
+
+	Describe("Listen", func() {
+		It("listens for notifications on every shard", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ch, err := cluster.Listen(ctx, "invalidate")
+			Expect(err).NotTo(HaveOccurred())
+
+			shard := cluster.Shard(2)
+			_, err = shard.Exec(`SELECT pg_notify(?, 'hello')`, sharding.ShardChannel(shard, "invalidate"))
+			Expect(err).NotTo(HaveOccurred())
+
+			var n sharding.ShardNotification
+			Eventually(ch, 5*time.Second).Should(Receive(&n))
+			Expect(n).To(Equal(sharding.ShardNotification{
+				ShardId: 2,
+				Channel: "invalidate",
+				Payload: "hello",
+			}))
+
+			cancel()
+			Eventually(ch, 5*time.Second).Should(BeClosed())
+		})
+	})
+
+	Describe("TryAdvisoryLock", func() {
+		It("takes shard advisory locks", func() {
+			unlock, ok, err := cluster.TryAdvisoryLock(1, 7)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			_, ok, err = cluster.TryAdvisoryLock(1, 7)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse())
+
+			unlock2, ok, err := cluster.TryAdvisoryLock(2, 7)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(unlock2()).NotTo(HaveOccurred())
+
+			Expect(unlock()).NotTo(HaveOccurred())
+			unlock, ok, err = cluster.TryAdvisoryLock(1, 7)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(unlock()).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("ExecOnServers", func() {
+		It("executes statement once per server", func() {
+			results, err := cluster.ExecOnServers("SELECT generate_series(1, 3)")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(HaveLen(1))
+			for _, res := range results {
+				Expect(res.RowsAffected()).To(Equal(3))
+			}
+		})
+	})
+
+	Describe("DisableServer", func() {
+		It("rejects writes to shards on disabled server", func() {
+			cluster.DisableServer(cluster.Servers()[0])
+
+			shard := cluster.Shard(2)
+			var n int64
+			_, err := shard.QueryOne(pg.Scan(&n), `SELECT ?shard_id`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int64(2)))
+
+			_, err = shard.Exec(`CREATE SCHEMA IF NOT EXISTS ?shard`)
+			Expect(err).To(HaveOccurred())
+			Expect(err.(pg.Error).Field('C')).To(Equal("25006"))
+
+			cluster.EnableServer(cluster.Servers()[0])
+			_, err = cluster.Shard(2).Exec(`CREATE SCHEMA IF NOT EXISTS ?shard`)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("ExecOneForEachShard", func() {
+		It("returns affected rows for each shard", func() {
+			affected, err := cluster.ExecOneForEachShard("SELECT 1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(affected).To(Equal(map[int64]int{0: 1, 1: 1, 2: 1, 3: 1}))
+		})
+
+		It("reports shards with mismatched row count", func() {
+			affected, err := cluster.ExecOneForEachShard("SELECT generate_series(1, ?shard_id)")
+			Expect(err).To(MatchError(
+				"sharding: expected 1 affected row on each shard, got shard0=0, shard2=2, shard3=3"))
+			Expect(affected).To(Equal(map[int64]int{0: 0, 1: 1, 2: 2, 3: 3}))
+		})
+
+		It("executes statement on disabled servers", func() {
+			cluster.DisableServer(cluster.Servers()[0])
+			affected, err := cluster.ExecOneForEachShard("SELECT 1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(affected).To(HaveLen(4))
+		})
+	})
+
+	Describe("CollectShards", func() {
+		It("concatenates rows in shard order", func() {
+			nums, err := sharding.CollectShards[int](
+				cluster, nil, "SELECT generate_series(1, ?shard_id)")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nums).To(Equal([]int{1, 1, 2, 1, 2, 3}))
+		})
+
+		It("uses model to allocate slices", func() {
+			var calls int32
+			nums, err := sharding.CollectShards(cluster, func() *[]int64 {
+				atomic.AddInt32(&calls, 1)
+				s := make([]int64, 0, 4)
+				return &s
+			}, "SELECT ?shard_id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nums).To(Equal([]int64{0, 1, 2, 3}))
+			Expect(calls).To(Equal(int32(4)))
+		})
+
+		It("includes disabled servers", func() {
+			cluster.DisableServer(cluster.Servers()[0])
+			nums, err := sharding.CollectShards[int64](cluster, nil, "SELECT ?shard_id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nums).To(Equal([]int64{0, 1, 2, 3}))
+		})
+	})
+
+	Describe("CrossShardCursor", func() {
+		const query = `
+			SELECT n FROM generate_series(?shard_id, 20, 4) n
+			WHERE n > ?after ORDER BY n LIMIT ?limit`
+
+		key := func(n int64) int64 {
+			return n
+		}
+
+		It("paginates across shards", func() {
+			var all []int64
+			var token string
+			for {
+				cur := sharding.NewCrossShardCursor(cluster, query, 3, key)
+				Expect(cur.Decode(token)).NotTo(HaveOccurred())
+
+				page, err := cur.Next()
+				Expect(err).NotTo(HaveOccurred())
+				if len(page) == 0 {
+					break
+				}
+				Expect(len(page)).To(BeNumerically("<=", 3))
+				all = append(all, page...)
+				token = cur.Encode()
+			}
+
+			var wanted []int64
+			for i := int64(0); i <= 20; i++ {
+				wanted = append(wanted, i)
+			}
+			Expect(all).To(Equal(wanted))
+		})
+
+		It("returns an error for invalid cursor", func() {
+			cur := sharding.NewCrossShardCursor(cluster, query, 3, key)
+			Expect(cur.Decode("%%%")).To(MatchError("sharding: invalid cursor"))
+			Expect(cur.Decode("gA")).To(MatchError("sharding: invalid cursor"))
+		})
+	})
+
+	Describe("EnsureInitialized", func() {
+		It("applies ddl only once", func() {
+			ddl := []string{
+				`CREATE TABLE ?shard.counters (n int)`,
+				`INSERT INTO ?shard.counters VALUES (?shard_id)`,
+			}
+			for i := 0; i < 3; i++ {
+				err := cluster.EnsureInitialized(context.Background(), ddl)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				defer GinkgoRecover()
+
+				var ns []int
+				_, err := shard.Query(&ns, `SELECT n FROM ?shard.counters`)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ns).To(Equal([]int{int(shardId(shard))}))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rolls back failed ddl", func() {
+			ddl := []string{
+				`CREATE TABLE ?shard.counters (n int)`,
+				`SELECT 1/(?shard_id - 2)`,
+			}
+			err := cluster.EnsureInitialized(context.Background(), ddl)
+			Expect(err).To(MatchError(ContainSubstring("division by zero")))
+
+			ddl[1] = `SELECT 1`
+			err = cluster.EnsureInitialized(context.Background(), ddl)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("initializes shards on disabled servers", func() {
+			cluster.DisableServer(cluster.Servers()[0])
+			err := cluster.EnsureInitialized(context.Background(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cluster.VerifySchemas(context.Background())).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("RunMigration", func() {
+		It("runs migration on shards that have not been migrated", func() {
+			var calls int32
+			migrate := func(shard *pg.DB) error {
+				atomic.AddInt32(&calls, 1)
+				if _, err := shard.Exec(`CREATE TABLE IF NOT EXISTS ?shard.counters (n int)`); err != nil {
+					return err
+				}
+				_, err := shard.Exec(`SELECT 1/(?shard_id - 2)`)
+				return err
+			}
+
+			var progress []int
+			err := cluster.RunMigration(context.Background(), "counters", migrate, func(done, total int) {
+				Expect(total).To(Equal(4))
+				progress = append(progress, done)
+			})
+			Expect(err).To(MatchError(ContainSubstring("division by zero")))
+			shardsErr := err.(*sharding.ShardsError)
+			Expect(shardsErr.Errors).To(HaveLen(1))
+			Expect(shardsErr.Errors[0].ShardId).To(Equal(int64(2)))
+			Expect(calls).To(Equal(int32(4)))
+			Expect(progress).To(Equal([]int{1, 2, 3}))
+
+			atomic.StoreInt32(&calls, 0)
+			err = cluster.RunMigration(context.Background(), "counters", func(shard *pg.DB) error {
+				atomic.AddInt32(&calls, 1)
+				return nil
+			}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(calls).To(Equal(int32(1)))
+		})
+	})
+
+	Describe("VerifySchemas", func() {
+		It("reports missing schemas per server", func() {
+			err := cluster.VerifySchemas(context.Background())
+			Expect(err).To(HaveOccurred())
+			missing := err.(*sharding.MissingSchemasError).Missing
+			Expect(missing).To(HaveLen(1))
+			for _, ids := range missing {
+				Expect(ids).To(Equal([]int64{0, 1, 2, 3}))
+			}
+			Expect(err.Error()).To(HaveSuffix(": shard0, shard1, shard2, shard3"))
+
+			err = cluster.EnsureInitialized(context.Background(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = cluster.Shard(2).Exec(`DROP SCHEMA ?shard CASCADE`)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = cluster.VerifySchemas(context.Background())
+			Expect(err).To(HaveOccurred())
+			for _, ids := range err.(*sharding.MissingSchemasError).Missing {
+				Expect(ids).To(Equal([]int64{2}))
+			}
+
+			err = cluster.EnsureInitialized(context.Background(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cluster.VerifySchemas(context.Background())).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("VerifySchemaPlacement", func() {
+		It("reports misplaced schemas", func() {
+			err := cluster.EnsureInitialized(context.Background(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cluster.VerifySchemaPlacement(context.Background())).NotTo(HaveOccurred())
+
+			_, err = cluster.Shard(2).Exec(`DROP SCHEMA ?shard CASCADE`)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = cluster.VerifySchemaPlacement(context.Background())
+			Expect(err).To(MatchError("sharding: schemas are not placed as expected: missing: shard2"))
+
+			// Both dbs connect to the same server, so every schema is
+			// also found on the other db.
+			db := pg.Connect(&pg.Options{
+				Addr: "127.0.0.1:5432",
+				User: "postgres",
+			})
+			defer db.Close()
+			server := cluster.Servers()[0]
+			cl := sharding.NewCluster([]*pg.DB{server, db}, 4)
+			err = cl.VerifySchemaPlacement(context.Background())
+			Expect(err).To(HaveOccurred())
+			placementErr := err.(*sharding.SchemaPlacementError)
+			Expect(placementErr.Missing).To(Equal([]int64{2}))
+			Expect(placementErr.Misplaced).To(HaveLen(3))
+			Expect(placementErr.Misplaced[1]).To(Equal([]*pg.DB{server}))
+			Expect(placementErr.Misplaced[0]).To(Equal([]*pg.DB{db}))
+		})
+	})
+
+	Describe("NewClusterFromSchemas", func() {
+		It("discovers shards from schemas", func() {
+			ctx := context.Background()
+			dbs := []*pg.DB{cluster.DBs()[0]}
+
+			_, err := sharding.NewClusterFromSchemas(ctx, dbs, nil)
+			Expect(err).To(MatchError("sharding: no shard schemas found"))
+
+			err = cluster.EnsureInitialized(ctx, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			cl, err := sharding.NewClusterFromSchemas(ctx, dbs, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cl.Shards(nil)).To(HaveLen(4))
+			Expect(sharding.QuotedShardName(cl.Shard(3))).To(Equal(`"shard3"`))
+
+			_, err = cluster.Shard(1).Exec(`DROP SCHEMA ?shard CASCADE`)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = sharding.NewClusterFromSchemas(ctx, dbs, nil)
+			Expect(err).To(MatchError("sharding: shard ids are not contiguous: shard1 is missing"))
+
+			_, err = sharding.NewClusterFromSchemas(ctx, dbs, sharding.NewIdGen(62, 1, 1, time.Now()))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("SearchPath", func() {
+		It("resolves unqualified names with SearchPath", func() {
+			err := cluster.EnsureInitialized(context.Background(), []string{
+				`CREATE TABLE ?shard.users (shard_id int)`,
+				`INSERT INTO ?shard.users VALUES (?shard_id)`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Every shard gets a pool of a single connection.
+			db := pg.Connect(&pg.Options{
+				User:     "postgres",
+				PoolSize: 4,
+			})
+			cl := sharding.NewClusterWithOptions([]*pg.DB{db}, 4, &sharding.ClusterOptions{
+				SearchPath: true,
+			})
+			defer cl.Close()
+
+			for i := 0; i < 2; i++ {
+				err = cl.ForEachShard(func(shard *pg.DB) error {
+					defer GinkgoRecover()
+					var n int64
+					_, err := shard.QueryOne(pg.Scan(&n), `SELECT shard_id FROM users`)
+					if err != nil {
+						return err
+					}
+					Expect(n).To(Equal(sharding.ShardId(shard)))
+					return nil
+				}, sharding.WithConcurrency(4))
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		It("pins shard to a single connection with SearchPath", func() {
+			err := cluster.EnsureInitialized(context.Background(), []string{
+				`CREATE TABLE ?shard.users (shard_id int)`,
+				`INSERT INTO ?shard.users VALUES (?shard_id)`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			db := pg.Connect(&pg.Options{
+				User: "postgres",
+			})
+			cl := sharding.NewClusterWithOptions([]*pg.DB{db}, 4, &sharding.ClusterOptions{
+				SearchPath: true,
+			})
+			defer cl.Close()
+
+			shard, release, err := cl.Pin(2)
+			Expect(err).NotTo(HaveOccurred())
+			defer release()
+
+			var pid int
+			_, err = shard.QueryOne(pg.Scan(&pid), `SELECT pg_backend_pid()`)
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 3; i++ {
+				var got, n int
+				_, err = shard.QueryOne(pg.Scan(&got, &n), `SELECT pg_backend_pid(), shard_id FROM users`)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got).To(Equal(pid))
+				Expect(n).To(Equal(2))
+			}
+		})
+
+		It("tags connections with ApplicationName with SearchPath", func() {
+			db := pg.Connect(&pg.Options{
+				User:     "postgres",
+				PoolSize: 4,
+			})
+			cl := sharding.NewClusterWithOptions([]*pg.DB{db}, 4, &sharding.ClusterOptions{
+				SearchPath:      true,
+				ApplicationName: "app",
+			})
+			defer cl.Close()
+
+			var name string
+			_, err := cl.Shard(3).QueryOne(pg.Scan(&name), `SHOW application_name`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(name).To(Equal("app/shard3"))
+
+			shard, release, err := cl.Pin(3)
+			Expect(err).NotTo(HaveOccurred())
+			release()
+			_, err = shard.Shard().QueryOne(pg.Scan(&name), `SHOW application_name`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(name).To(Equal("app/shard3"))
+		})
+	})
+
+	Describe("TxOnShardForId", func() {
+		It("runs transaction on the shard of the id", func() {
+			err := cluster.EnsureInitialized(context.Background(), []string{
+				`CREATE TABLE ?shard.users (id bigint)`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx := context.Background()
+			id := sharding.DefaultIdGen.NextId(time.Now(), 2, 1)
+			err = cluster.TxOnShardForId(ctx, id, func(tx *pg.Tx) error {
+				_, err := tx.Exec(`INSERT INTO ?shard.users VALUES (?)`, id)
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(func() {
+				_ = cluster.TxOnShardForId(ctx, id, func(tx *pg.Tx) error {
+					_, err := tx.Exec(`INSERT INTO ?shard.users VALUES (?)`, id)
+					Expect(err).NotTo(HaveOccurred())
+					panic("fake panic")
+				})
+			}).To(Panic())
+
+			n, err := cluster.CountRows(ctx, "users")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int64(1)))
+
+			var got int64
+			err = sharding.QueryScalar(cluster.Shard(2), &got, `SELECT id FROM ?shard.users`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(Equal(id))
+		})
+	})
+
+	Describe("DeleteByIds", func() {
+		It("deletes rows by ids on each shard", func() {
+			err := cluster.EnsureInitialized(context.Background(), []string{
+				`CREATE TABLE ?shard."Users" (id bigint)`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var ids []int64
+			for i := int64(0); i < 8; i++ {
+				id := sharding.DefaultIdGen.NextId(time.Now(), i%4, i)
+				_, err := cluster.SplitShard(id).Exec(`INSERT INTO ?shard."Users" VALUES (?)`, id)
+				Expect(err).NotTo(HaveOccurred())
+				ids = append(ids, id)
+			}
+
+			n, err := cluster.DeleteByIds(context.Background(), "Users", append(ids[:3:3], 42))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(3))
+
+			n, err = cluster.DeleteByIds(context.Background(), "Users", ids)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(5))
+		})
+	})
+
+	Describe("DeleteByIdsInOrder", func() {
+		It("deletes rows in order in transaction", func() {
+			err := cluster.EnsureInitialized(context.Background(), []string{
+				`CREATE TABLE ?shard.parents (id bigint PRIMARY KEY)`,
+				`CREATE TABLE ?shard.children (parent_id bigint REFERENCES ?shard.parents)`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var ids []int64
+			for i := int64(0); i < 4; i++ {
+				id := sharding.DefaultIdGen.NextId(time.Now(), i, i)
+				shard := cluster.SplitShard(id)
+				_, err := shard.Exec(`INSERT INTO ?shard.parents VALUES (?)`, id)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = shard.Exec(`INSERT INTO ?shard.children VALUES (?), (?)`, id, id)
+				Expect(err).NotTo(HaveOccurred())
+				ids = append(ids, id)
+			}
+
+			_, err = cluster.DeleteByIdsInOrder(context.Background(), []sharding.DeleteStep{
+				{Table: "parents"},
+			}, ids[:1])
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*sharding.ShardError).ShardId).To(Equal(int64(0)))
+
+			n, err := cluster.DeleteByIdsInOrder(context.Background(), []sharding.DeleteStep{
+				{Table: "children", Column: "parent_id"},
+				{Table: "parents"},
+			}, ids)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(12))
+		})
+	})
+
+	Describe("CountRows", func() {
+		It("counts rows across shards", func() {
+			err := cluster.EnsureInitialized(context.Background(), []string{
+				`CREATE TABLE ?shard."Users" (id bigint)`,
+				`INSERT INTO ?shard."Users" SELECT generate_series(1, ?shard_id)`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			n, err := cluster.CountRows(context.Background(), "Users")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int64(0 + 1 + 2 + 3)))
+
+			_, err = cluster.Shard(2).Exec(`DROP TABLE ?shard."Users"`)
+			Expect(err).NotTo(HaveOccurred())
+
+			n, err = cluster.CountRows(context.Background(), "Users")
+			Expect(n).To(Equal(int64(0 + 1 + 3)))
+			shardsErr := err.(*sharding.ShardsError)
+			Expect(shardsErr.Errors).To(HaveLen(1))
+			Expect(shardsErr.Errors[0].ShardId).To(Equal(int64(2)))
+		})
+	})
+
+	Describe("MaxId", func() {
+		It("returns max id across shards", func() {
+			err := cluster.EnsureInitialized(context.Background(), []string{
+				`CREATE TABLE ?shard.users (id bigint)`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			maxId, err := cluster.MaxId(context.Background(), "users")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(maxId).To(BeZero())
+
+			for i := int64(1); i <= 3; i++ {
+				_, err := cluster.Shard(i).Exec(`INSERT INTO ?shard.users VALUES (?)`, -i*10)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			maxId, err = cluster.MaxId(context.Background(), "users")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(maxId).To(Equal(int64(-10)))
+		})
+	})
+
+	Describe("Vacuum", func() {
+		It("vacuums tables of every shard", func() {
+			err := cluster.EnsureInitialized(context.Background(), []string{
+				`CREATE TABLE ?shard."Users" (id bigint)`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			outcomes, err := cluster.Vacuum(context.Background(), &sharding.VacuumOptions{
+				Analyze: true,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(outcomes).To(HaveLen(4))
+			for i, outcome := range outcomes {
+				Expect(outcome.ShardId).To(Equal(int64(i)))
+				Expect(outcome.Err).NotTo(HaveOccurred())
+			}
+		})
+	})
+
+	Describe("CopyFromSlice", func() {
+		It("copies rows from slice", func() {
+			err := cluster.EnsureInitialized(context.Background(), []string{
+				`CREATE TABLE ?shard.events (id bigint, "Name" text, payload bytea)`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			shard := cluster.Shard(1)
+			n, err := sharding.CopyFromSlice(shard, "events", []string{"id", "Name", "payload"}, [][]interface{}{
+				{1, "tab\there", []byte("hello")},
+				{2, nil, nil},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(2))
+
+			var names []*string
+			var payloads [][]byte
+			_, err = shard.QueryOne(pg.Scan(pg.Array(&names)), `SELECT array_agg("Name" ORDER BY id) FROM ?shard.events`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names).To(HaveLen(2))
+			Expect(*names[0]).To(Equal("tab\there"))
+			Expect(names[1]).To(BeNil())
+
+			_, err = shard.QueryOne(pg.Scan(pg.Array(&payloads)), `SELECT array_agg(payload ORDER BY id) FROM ?shard.events`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(payloads[0]).To(Equal([]byte("hello")))
+		})
+	})
+
+	Describe("CopyFrom", func() {
+		It("returns number of copied rows", func() {
+			err := cluster.EnsureInitialized(context.Background(), []string{
+				`CREATE TABLE ?shard.events (id bigint)`,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			shard := cluster.Shard(2)
+			rows := make([][]interface{}, 1000)
+			for i := range rows {
+				rows[i] = []interface{}{i}
+			}
+			n, err := sharding.CopyFromSlice(shard, "events", []string{"id"}, rows)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(len(rows)))
+
+			n, err = sharding.CopyFrom(shard, strings.NewReader("1\n2\n3\n"), `COPY ?shard.events FROM STDIN`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(3))
+
+			count, err := cluster.CountRows(context.Background(), "events")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(int64(1003)))
+		})
+	})
+})
+
+var _ = Describe("PoolTimeout", func() {
+	var cluster *sharding.Cluster
+
+	BeforeEach(func() {
+		db := pg.Connect(&pg.Options{
+			User:     "postgres",
+			PoolSize: 1,
+		})
+		cluster = sharding.NewClusterWithOptions([]*pg.DB{db}, 2, &sharding.ClusterOptions{
+			PoolTimeout: 100 * time.Millisecond,
+		})
+	})
+
+	AfterEach(func() {
+		Expect(cluster.Close()).NotTo(HaveOccurred())
+	})
+
+	It("returns ErrPoolTimeout when pool is exhausted", func() {
+		tx, err := cluster.Shard(0).Begin()
+		Expect(err).NotTo(HaveOccurred())
+		defer tx.Rollback()
+
+		start := time.Now()
+		_, err = cluster.Shard(1).Exec(`SELECT 1`)
+		Expect(sharding.IsPoolTimeout(err)).To(BeTrue())
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+		err = cluster.ForEachShard(func(shard *pg.DB) error {
+			_, err := shard.Exec(`SELECT 1`)
+			return err
+		})
+		Expect(err).To(Equal(sharding.ErrPoolTimeout))
+		Expect(sharding.IsPoolTimeout(err)).To(BeTrue())
+	})
+})
+
+var _ = Describe("StatementTimeout", func() {
+	var cluster *sharding.Cluster
+
+	BeforeEach(func() {
+		db := pg.Connect(&pg.Options{
+			User:     "postgres",
+			PoolSize: 1,
+		})
+		cluster = sharding.NewClusterWithOptions([]*pg.DB{db}, 2, &sharding.ClusterOptions{
+			StatementTimeout: 100 * time.Millisecond,
+		})
+	})
+
+	AfterEach(func() {
+		Expect(cluster.Close()).NotTo(HaveOccurred())
+	})
+
+	It("cancels long statements on the server", func() {
+		shard := cluster.Shard(1)
+		_, err := shard.Exec(`SELECT pg_sleep(5)`)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(pg.Error).Field('C')).To(Equal("57014"))
+
+		var timeout string
+		_, err = shard.QueryOne(pg.Scan(&timeout), `SHOW statement_timeout`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(timeout).To(Equal("100ms"))
+	})
+})
+
+var _ = Describe("Pin", func() {
+	var cluster *sharding.Cluster
+
+	BeforeEach(func() {
+		db := pg.Connect(&pg.Options{
+			User:        "postgres",
+			PoolSize:    1,
+			PoolTimeout: 100 * time.Millisecond,
+		})
+		cluster = sharding.NewClusterWithOptions([]*pg.DB{db}, 4, &sharding.ClusterOptions{
+			ApplicationName: "app",
+		})
+	})
+
+	AfterEach(func() {
+		Expect(cluster.Close()).NotTo(HaveOccurred())
+	})
+
+	It("checks out connection from the shard's pool", func() {
+		shard, release, err := cluster.Pin(3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(shard.ShardId()).To(Equal(int64(3)))
+
+		var pid1, pid2 int
+		_, err = shard.QueryOne(pg.Scan(&pid1), `SELECT pg_backend_pid()`)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = shard.QueryOne(pg.Scan(&pid2), `SELECT pg_backend_pid()`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pid2).To(Equal(pid1))
+
+		_, _, err = cluster.Pin(2)
+		Expect(err).To(HaveOccurred())
+
+		release()
+		release()
+
+		var pid3 int
+		_, err = cluster.Shard(2).QueryOne(pg.Scan(&pid3), `SELECT pg_backend_pid()`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pid3).To(Equal(pid1))
+	})
+
+	It("resets application name and session locks on release", func() {
+		shard, release, err := cluster.Pin(3)
+		Expect(err).NotTo(HaveOccurred())
+
+		var name string
+		_, err = shard.QueryOne(pg.Scan(&name), `SHOW application_name`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(name).To(Equal("app/shard3"))
+
+		_, err = shard.Exec(`SELECT pg_advisory_lock(42)`)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = shard.Exec(`BEGIN`)
+		Expect(err).NotTo(HaveOccurred())
+		release()
+
+		var locked bool
+		_, err = cluster.Shard(3).QueryOne(pg.Scan(&name, &locked), `
+			SELECT current_setting('application_name'), pg_try_advisory_lock(42)`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(name).To(BeEmpty())
+		Expect(locked).To(BeTrue())
+		_, err = cluster.Shard(3).Exec(`SELECT pg_advisory_unlock(42)`)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("context-bound cluster", func() {
+	var cluster *sharding.Cluster
+
+	BeforeEach(func() {
+		db := pg.Connect(&pg.Options{
+			User: "postgres",
+		})
+		cluster = sharding.NewClusterWithOptions([]*pg.DB{db}, 4, &sharding.ClusterOptions{
+			// The server is its own replica, so its lag is zero.
+			Replicas: map[*pg.DB]*pg.DB{db: db},
+		})
+		dropShardSchemas(cluster)
+		Expect(cluster.EnsureInitialized(context.Background(), nil)).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(cluster.Close()).NotTo(HaveOccurred())
+	})
+
+	It("matches shards to servers", func() {
+		cl := cluster.WithContext(context.Background())
+
+		lag, err := cl.ReplicaLag(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lag).To(Equal(map[int64]time.Duration{0: 0, 1: 0, 2: 0, 3: 0}))
+
+		Expect(cl.VerifySchemas(context.Background())).NotTo(HaveOccurred())
+		Expect(cl.VerifySchemaPlacement(context.Background())).NotTo(HaveOccurred())
+
+		_, err = cl.Shard(2).Exec(`DROP SCHEMA ?shard CASCADE`)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = cl.VerifySchemas(context.Background())
+		Expect(err).To(HaveOccurred())
+		for _, ids := range err.(*sharding.MissingSchemasError).Missing {
+			Expect(ids).To(Equal([]int64{2}))
+		}
+		err = cl.VerifySchemaPlacement(context.Background())
+		Expect(err).To(MatchError("sharding: schemas are not placed as expected: missing: shard2"))
+	})
+})
+
+type queryLog struct {
+	mu      sync.Mutex
+	shardId int64
+	query   string
+	args    []interface{}
+	dur     time.Duration
+	err     error
+}
+
+func (l *queryLog) LogQuery(
+	shardId int64, query string, args []interface{}, dur time.Duration, err error,
+) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.shardId = shardId
+	l.query = query
+	l.args = args
+	l.dur = dur
+	l.err = err
+}
+
+type spanKey struct{}
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	ended  bool
+	err    error
+}
+
+func (s *testSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(
+	ctx context.Context, name string, start time.Time, attrs map[string]interface{},
+) (context.Context, sharding.Span) {
+	parent, _ := ctx.Value(spanKey{}).(*testSpan)
+	span := &testSpan{
+		name:   name,
+		parent: parent,
+		attrs:  attrs,
+	}
+
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+var _ = Describe("QueryLogger", func() {
+	var log *queryLog
+
+	newCluster := func(redact bool) *sharding.Cluster {
+		db := pg.Connect(&pg.Options{
+			User: "postgres",
+		})
+		return sharding.NewClusterWithOptions([]*pg.DB{db}, 4, &sharding.ClusterOptions{
+			QueryLogger:  log,
+			RedactParams: redact,
+		})
+	}
+
+	BeforeEach(func() {
+		log = new(queryLog)
+	})
+
+	It("logs formatted query with shard id", func() {
+		cluster := newCluster(false)
+		defer cluster.Close()
+
+		_, err := cluster.Shard(2).Exec(`SELECT '?shard', ?`, "secret")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(log.shardId).To(Equal(int64(2)))
+		Expect(log.query).To(Equal(`SELECT '"shard2"', 'secret'`))
+		Expect(log.args).To(Equal([]interface{}{"secret"}))
+		Expect(log.err).NotTo(HaveOccurred())
+	})
+
+	It("redacts args", func() {
+		cluster := newCluster(true)
+		defer cluster.Close()
+
+		_, err := cluster.Shard(2).Exec(`SELECT '?shard', ?`, "secret")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(log.query).To(Equal(`SELECT '"shard2"', ?`))
+		Expect(log.args).To(BeNil())
+	})
+
+	It("logs only slow queries", func() {
+		db := pg.Connect(&pg.Options{
+			User: "postgres",
+		})
+		cluster := sharding.NewClusterWithOptions([]*pg.DB{db}, 4, &sharding.ClusterOptions{
+			QueryLogger:        log,
+			SlowQueryThreshold: 50 * time.Millisecond,
+		})
+		defer cluster.Close()
+
+		_, err := cluster.Shard(1).Exec(`SELECT 1`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(log.query).To(BeEmpty())
+
+		_, err = cluster.Shard(1).Exec(`SELECT pg_sleep(0.1), ?shard_id`)
 		Expect(err).NotTo(HaveOccurred())
-		Expect(shardName).To(Equal(`"shard3"`))
-		Expect(hello).To(Equal("hello"))
+		Expect(log.shardId).To(Equal(int64(1)))
+		Expect(log.query).To(Equal(`SELECT pg_sleep(0.1), 1`))
+		Expect(log.dur).To(BeNumerically(">=", 50*time.Millisecond))
+	})
+})
+
+var _ = Describe("Cluster", func() {
+	var db1, db2 *pg.DB
+	var cluster *sharding.Cluster
+
+	BeforeEach(func() {
+		db1 = pg.Connect(&pg.Options{
+			Addr: "db1",
+		})
+		db2 = pg.Connect(&pg.Options{
+			Addr: "db2",
+		})
+		Expect(db1).NotTo(Equal(db2))
+		cluster = sharding.NewCluster([]*pg.DB{db1, db2, db1, db2}, 4)
+	})
+
+	AfterEach(func() {
+		Expect(cluster.Close()).NotTo(HaveOccurred())
+	})
+
+	Describe("DryRun", func() {
+		It("records statements without sending them to the server", func() {
+			db := pg.Connect(&pg.Options{
+				Addr: "localhost:1",
+			})
+			cl := sharding.NewCluster([]*pg.DB{db}, 4)
+			defer cl.Close()
+
+			stmts, err := cl.DryRun(func(shard *pg.DB) error {
+				defer GinkgoRecover()
+
+				queries := []string{
+					`CREATE SCHEMA IF NOT EXISTS ?shard`,
+					`CREATE INDEX CONCURRENTLY users_name_idx ON ?shard.users (name)`,
+				}
+				for _, q := range queries {
+					res, err := shard.Exec(q)
+					if err != nil {
+						return err
+					}
+					Expect(res.RowsAffected()).To(BeZero())
+				}
+				_, err := shard.QueryOne(pg.Scan(new(int)), `SELECT count(*) FROM ?shard.users WHERE id = ?`, 42)
+				Expect(err).To(Equal(pg.ErrNoRows))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stmts).To(HaveLen(4))
+			Expect(stmts[3]).To(Equal([]string{
+				`CREATE SCHEMA IF NOT EXISTS "shard3"`,
+				`CREATE INDEX CONCURRENTLY users_name_idx ON "shard3".users (name)`,
+				`SELECT count(*) FROM "shard3".users WHERE id = 42`,
+			}))
+		})
+
+		It("returns an error for COPY", func() {
+			stmts, err := cluster.DryRun(func(shard *pg.DB) error {
+				_, err := shard.CopyFrom(strings.NewReader("1\n"), `COPY ?shard.users FROM STDIN`)
+				return err
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("sharding: COPY is not supported in dry run"))
+			Expect(stmts[1]).To(Equal([]string{`COPY "shard1".users FROM STDIN`}))
+		})
+	})
+
+	It("distributes shards on servers", func() {
+		var dbs []*pg.DB
+		for i := 0; i < 16; i++ {
+			db := pg.Connect(&pg.Options{
+				Addr: fmt.Sprintf("db%d", i),
+			})
+			dbs = append(dbs, db)
+		}
+
+		tests := []struct {
+			dbs    []int
+			db     int
+			shards []int64
+		}{
+			{[]int{0}, 0, []int64{0, 1, 2, 3, 4, 5, 6, 7}},
+
+			{[]int{0, 1}, 0, []int64{0, 2, 4, 6}},
+			{[]int{0, 1}, 1, []int64{1, 3, 5, 7}},
+
+			{[]int{0, 1, 2, 3}, 0, []int64{0, 4}},
+			{[]int{0, 1, 2, 3}, 1, []int64{1, 5}},
+			{[]int{0, 1, 2, 3}, 2, []int64{2, 6}},
+			{[]int{0, 1, 2, 3}, 3, []int64{3, 7}},
+
+			{[]int{0, 1, 2, 1}, 0, []int64{0, 4}},
+			{[]int{0, 1, 2, 1}, 1, []int64{1, 3, 5, 7}},
+			{[]int{0, 1, 2, 1}, 2, []int64{2, 6}},
+
+			{[]int{0, 1, 2, 3}, 0, []int64{0, 4}},
+			{[]int{0, 1, 2, 3}, 1, []int64{1, 5}},
+			{[]int{0, 1, 2, 3}, 2, []int64{2, 6}},
+			{[]int{0, 1, 2, 3}, 3, []int64{3, 7}},
+		}
+		for _, test := range tests {
+			var cldbs []*pg.DB
+			for _, ind := range test.dbs {
+				cldbs = append(cldbs, dbs[ind])
+			}
+			cluster = sharding.NewCluster(cldbs, 8)
+
+			var shardIds []int64
+			for _, shard := range cluster.Shards(dbs[test.db]) {
+				shardIds = append(shardIds, shardId(shard))
+			}
+			Expect(shardIds).To(Equal(test.shards))
+		}
+	})
+
+	It("distributes projects on different servers", func() {
+		tests := []struct {
+			projectId int64
+			wanted    *pg.DB
+		}{
+			{0, db1},
+			{1, db2},
+			{2, db1},
+			{3, db2},
+			{4, db1},
+		}
+
+		for _, test := range tests {
+			shard := cluster.Shard(test.projectId)
+			Expect(shard.Options()).To(Equal(test.wanted.Options()))
+		}
+	})
+
+	It("routes ids with SplitShard without allocations", func() {
+		gen := sharding.DefaultIdGen
+		id := gen.NextId(time.Now(), 6, 1)
+		var shard *pg.DB
+		allocs := testing.AllocsPerRun(100, func() {
+			shard = cluster.SplitShard(id)
+		})
+		Expect(shardId(shard)).To(Equal(int64(2)))
+		Expect(allocs).To(BeZero())
+	})
+
+	Describe("ForEachDB", func() {
+		It("fn is called once for every database", func() {
+			var dbs []*pg.DB
+			var mu sync.Mutex
+			err := cluster.ForEachDB(func(db *pg.DB) error {
+				defer GinkgoRecover()
+				mu.Lock()
+				Expect(dbs).NotTo(ContainElement(db))
+				dbs = append(dbs, db)
+				mu.Unlock()
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dbs).To(HaveLen(2))
+		})
+
+		It("returns an error if fn fails", func() {
+			err := cluster.ForEachDB(func(db *pg.DB) error {
+				if db == db2 {
+					return errors.New("fake error")
+				}
+				return nil
+			})
+			Expect(err).To(MatchError("fake error"))
+		})
+	})
+
+	Describe("ForEachShard", func() {
+		It("fn is called once for every shard", func() {
+			var shards []int64
+			var mu sync.Mutex
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				defer GinkgoRecover()
+
+				mu.Lock()
+				Expect(shards).NotTo(ContainElement(shardId))
+				shards = append(shards, shardId(shard))
+				mu.Unlock()
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shards).To(HaveLen(4))
+			for shardId := int64(0); shardId < 4; shardId++ {
+				Expect(shards).To(ContainElement(shardId))
+			}
+		})
+
+		It("returns an error if fn fails", func() {
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				if shardId(shard) == 3 {
+					return errors.New("fake error")
+				}
+				return nil
+			})
+			Expect(err).To(MatchError("fake error"))
+		})
+	})
+
+	It("returns error when listener can't connect", func() {
+		_, err := cluster.Listen(context.Background(), "invalidate")
+		Expect(err).To(HaveOccurred())
+		Expect(sharding.ShardChannel(cluster.Shard(3), "invalidate")).To(Equal("shard3:invalidate"))
+	})
+
+	It("returns shards by server address", func() {
+		db3 := pg.Connect(&pg.Options{
+			Addr: "db3:5432",
+		})
+		defer db3.Close()
+		cl := sharding.NewCluster([]*pg.DB{db1, db3}, 4)
+
+		var ids []int64
+		for _, shard := range cl.ShardsForServerName("db3") {
+			ids = append(ids, shardId(shard))
+		}
+		Expect(ids).To(Equal([]int64{1, 3}))
+		Expect(cl.ShardsForServerName("db3:5432")).To(HaveLen(2))
+		Expect(cl.ShardsForServerName("db1")).To(HaveLen(2))
+		Expect(cl.ShardsForServerName("db3:5433")).To(BeEmpty())
+		Expect(cl.ShardsForServerName("db")).To(BeEmpty())
+	})
+
+	It("streams shard results", func() {
+		ch := sharding.ForEachShardStream(cluster, func(shard *pg.DB) (string, error) {
+			if shardId(shard) == 2 {
+				return "", errors.New("fake error")
+			}
+			return sharding.QuotedShardName(shard), nil
+		})
+
+		results := make(map[int64]sharding.ShardResult[string])
+		for res := range ch {
+			results[res.ShardId] = res
+		}
+		Expect(results).To(HaveLen(4))
+		Expect(results[1].Value).To(Equal(`"shard1"`))
+		Expect(results[1].Err).NotTo(HaveOccurred())
+		Expect(results[2].Err).To(MatchError("fake error"))
+	})
+
+	It("streams each shard once with retries", func() {
+		var mu sync.Mutex
+		attempts := make(map[int64]int)
+		ch := sharding.ForEachShardStream(cluster, func(shard *pg.DB) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts[shardId(shard)]++
+			n := attempts[shardId(shard)]
+			if shardId(shard) == 2 || n < 2 {
+				return n, errors.New("fake error")
+			}
+			return n, nil
+		}, sharding.WithRetry(3, 0))
+
+		var results []sharding.ShardResult[int]
+		for res := range ch {
+			results = append(results, res)
+		}
+		Expect(results).To(HaveLen(4))
+		for _, res := range results {
+			if res.ShardId == 2 {
+				Expect(res.Value).To(Equal(4))
+				Expect(res.Err).To(MatchError("fake error"))
+			} else {
+				Expect(res.Value).To(Equal(2))
+				Expect(res.Err).NotTo(HaveOccurred())
+			}
+		}
+	})
+
+	It("coalesces debounced sweeps", func() {
+		var mu sync.Mutex
+		var calls int
+		sweep := cluster.ForEachShardDebounced(50*time.Millisecond, func(shard *pg.DB) error {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			return errors.New("fake error")
+		})
+
+		var wg sync.WaitGroup
+		errs := make([]error, 3)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				errs[i] = sweep(context.Background())
+			}(i)
+		}
+		wg.Wait()
+
+		Expect(calls).To(Equal(4))
+		for _, err := range errs {
+			Expect(err).To(MatchError("fake error"))
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(sweep(ctx)).To(Equal(context.Canceled))
+
+		Expect(sweep(context.Background())).To(HaveOccurred())
+		Expect(calls).To(Equal(8))
+	})
+
+	Describe("Partition", func() {
+		It("returns least loaded shard", func() {
+			loads := map[int64]int64{0: 5, 1: 2, 2: 7, 3: 2}
+			id, err := cluster.Partition(context.Background(), func(shard *pg.DB) (int64, error) {
+				return loads[shardId(shard)], nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).To(Equal(int64(1)))
+
+			cluster.DisableServer(db2)
+			id, err = cluster.Partition(context.Background(), func(shard *pg.DB) (int64, error) {
+				return loads[shardId(shard)], nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).To(Equal(int64(0)))
+		})
+
+		It("returns load error", func() {
+			_, err := cluster.Partition(context.Background(), func(shard *pg.DB) (int64, error) {
+				return 0, errors.New("fake error")
+			})
+			Expect(err).To(MatchError("fake error"))
+		})
+	})
+
+	Describe("ForEachShardWithID", func() {
+		It("passes shard id to fn", func() {
+			var mu sync.Mutex
+			ids := make(map[int64]int64)
+			err := cluster.ForEachShardWithID(func(id int64, shard *pg.DB) error {
+				mu.Lock()
+				ids[id] = shardId(shard)
+				mu.Unlock()
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal(map[int64]int64{0: 0, 1: 1, 2: 2, 3: 3}))
+		})
+	})
+
+	Describe("ForEachNShards", func() {
+		It("fn is called once for every shard", func() {
+			var shards []int64
+			var mu sync.Mutex
+			err := cluster.ForEachNShards(2, func(shard *pg.DB) error {
+				defer GinkgoRecover()
+
+				shardId := shardId(shard)
+				mu.Lock()
+				Expect(shards).NotTo(ContainElement(shardId))
+				shards = append(shards, shardId)
+				mu.Unlock()
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shards).To(HaveLen(4))
+			for shardId := int64(0); shardId < 4; shardId++ {
+				Expect(shards).To(ContainElement(shardId))
+			}
+		})
+
+		It("returns an error if fn fails", func() {
+			err := cluster.ForEachNShards(2, func(shard *pg.DB) error {
+				if shardId(shard) == 3 {
+					return errors.New("fake error")
+				}
+				return nil
+			})
+			Expect(err).To(MatchError("fake error"))
+		})
+	})
+
+	It("counts shards per server", func() {
+		db1Copy := pg.Connect(db1.Options())
+		defer db1Copy.Close()
+
+		cl := sharding.NewCluster([]*pg.DB{db1, db2, db1Copy}, 6)
+		Expect(cl.ShardCountPerServer()).To(Equal(map[*pg.DB]int{
+			db1: 4,
+			db2: 2,
+		}))
+	})
+
+	Describe("ForEachShardInServerOrder", func() {
+		It("processes shards on a server one at a time in order", func() {
+			cl := sharding.NewCluster([]*pg.DB{db1, db2}, 8)
+
+			var mu sync.Mutex
+			active := make(map[string]int)
+			order := make(map[string][]int64)
+			err := cl.ForEachShardInServerOrder(func(shard *pg.DB) error {
+				defer GinkgoRecover()
+
+				addr := shard.Options().Addr
+				mu.Lock()
+				active[addr]++
+				Expect(active[addr]).To(Equal(1))
+				order[addr] = append(order[addr], shardId(shard))
+				mu.Unlock()
+
+				time.Sleep(5 * time.Millisecond)
+
+				mu.Lock()
+				active[addr]--
+				mu.Unlock()
+				return nil
+			}, sharding.WithConcurrency(4))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(order).To(Equal(map[string][]int64{
+				"db1": {0, 2, 4, 6},
+				"db2": {1, 3, 5, 7},
+			}))
+		})
+	})
+
+	Describe("server identity", func() {
+		It("dedups same *pg.DB passed several times", func() {
+			Expect(cluster.Shards(db1)).To(HaveLen(2))
+			Expect(cluster.Shards(db2)).To(HaveLen(2))
+		})
+
+		It("dedups distinct *pg.DB with same options", func() {
+			db3 := pg.Connect(&pg.Options{
+				Addr: "db1",
+			})
+			cl := sharding.NewCluster([]*pg.DB{db1, db3}, 4)
+
+			var n int32
+			err := cl.ForEachDB(func(db *pg.DB) error {
+				atomic.AddInt32(&n, 1)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int32(1)))
+
+			var shards []int64
+			var mu sync.Mutex
+			err = cl.ForEachShard(func(shard *pg.DB) error {
+				mu.Lock()
+				shards = append(shards, shardId(shard))
+				mu.Unlock()
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shards).To(ConsistOf(int64(0), int64(1), int64(2), int64(3)))
+
+			Expect(cl.Shards(db1)).To(HaveLen(4))
+			Expect(cl.Shards(db3)).To(HaveLen(4))
+			Expect(db3.Close()).NotTo(HaveOccurred())
+		})
+
+		It("distinguishes databases on the same server", func() {
+			db3 := pg.Connect(&pg.Options{
+				Addr:     "db1",
+				Database: "other",
+			})
+			cl := sharding.NewCluster([]*pg.DB{db1, db3}, 4)
+			Expect(cl.Shards(db1)).To(HaveLen(2))
+			Expect(cl.Shards(db3)).To(HaveLen(2))
+			Expect(db3.Close()).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("VerifyLayout", func() {
+		It("accepts power of two shards", func() {
+			Expect(cluster.VerifyLayout()).NotTo(HaveOccurred())
+		})
+
+		It("rejects shards that are not a power of two", func() {
+			cl := sharding.NewCluster([]*pg.DB{db1, db2}, 6)
+			Expect(cl.VerifyLayout()).To(MatchError("sharding: nshards=6 is not a power of two"))
+
+			Expect(func() {
+				sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 6, &sharding.ClusterOptions{
+					VerifyLayout: true,
+				})
+			}).To(Panic())
+		})
+	})
+
+	Describe("PoolTimeout", func() {
+		It("opens cluster pools with timeouts", func() {
+			cl := sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+				PoolTimeout:      time.Second,
+				StatementTimeout: time.Minute,
+			})
+			shard := cl.Shard(1)
+			Expect(shard.Options().Addr).To(Equal("db2"))
+			Expect(shard.Options().PoolTimeout).To(Equal(time.Second))
+			Expect(shard.Options().OnConnect).NotTo(BeNil())
+			Expect(cl.Shard(3).Options()).To(Equal(shard.Options()))
+
+			Expect(db2.Options().PoolTimeout).NotTo(Equal(time.Second))
+			Expect(db2.Options().OnConnect).To(BeNil())
+		})
+	})
+
+	Describe("Pin", func() {
+		It("returns an error when connection can't be checked out", func() {
+			shard, release, err := cluster.Pin(5)
+			Expect(err).To(HaveOccurred())
+			Expect(shard).To(BeNil())
+			Expect(release).To(BeNil())
+		})
+	})
+
+	Describe("Config", func() {
+		It("round-trips cluster layout through JSON", func() {
+			b, err := json.Marshal(cluster.Config())
+			Expect(err).NotTo(HaveOccurred())
+
+			var cfg sharding.ClusterConfig
+			Expect(json.Unmarshal(b, &cfg)).NotTo(HaveOccurred())
+			Expect(cfg.DBs).To(Equal([]int{0, 1, 0, 1}))
+			Expect(cfg.Shards).To(Equal([]int{0, 1, 0, 1}))
+			Expect(cfg.IdGen.TimeBits).To(Equal(uint(41)))
+			Expect(cfg.IdGen.Epoch.Year()).To(Equal(2010))
+
+			cl, err := sharding.NewClusterFromConfig(&cfg, func(server sharding.ServerConfig) *pg.DB {
+				return pg.Connect(&pg.Options{
+					Network:  server.Network,
+					Addr:     server.Addr,
+					User:     server.User,
+					Database: server.Database,
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer cl.Close()
+
+			Expect(cl.Config()).To(Equal(cluster.Config()))
+			for i := int64(0); i < 4; i++ {
+				Expect(cl.Shard(i).Options().Addr).To(Equal(cluster.Shard(i).Options().Addr))
+			}
+		})
+
+		It("rejects inconsistent placement", func() {
+			cfg := cluster.Config()
+			cfg.Shards[1] = 0
+			_, err := sharding.NewClusterFromConfig(cfg, nil)
+			Expect(err).To(MatchError("sharding: shard 1 is placed on server 0, expected 1"))
+		})
+	})
+
+	It("applies DefaultTimeout to shards", func() {
+		cl := sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+			DefaultTimeout: 3 * time.Second,
+		})
+		shard := cl.Shard(1)
+		Expect(shard.Options().Addr).To(Equal("db2"))
+		Expect(shard.Options().ReadTimeout).To(Equal(3 * time.Second))
+		Expect(shard.Options().WriteTimeout).To(Equal(3 * time.Second))
+		Expect(db2.Options().ReadTimeout).To(BeZero())
+
+		shard = shard.WithTimeout(time.Second)
+		Expect(shard.Options().ReadTimeout).To(Equal(time.Second))
+		Expect(shardId(shard)).To(Equal(int64(1)))
+	})
+
+	It("returns nil shards for clusters without shards", func() {
+		var cl sharding.Cluster
+		Expect(cl.Shard(1)).To(BeNil())
+		Expect(cl.SplitShard(1)).To(BeNil())
+		Expect(cl.DB(1)).To(BeNil())
+		Expect(cl.ReplicaShard(1)).To(BeNil())
+
+		var sub sharding.SubCluster
+		Expect(sub.Shard(1)).To(BeNil())
+		Expect(sub.SplitShard(1)).To(BeNil())
+	})
+
+	It("returns ErrNoShards when routing ids of clusters without shards", func() {
+		var cl sharding.Cluster
+		_, err := cl.QueryShard(1, pg.Discard, `SELECT 1`)
+		Expect(err).To(Equal(sharding.ErrNoShards))
+		err = cl.TxOnShardForId(context.Background(), 1, func(tx *pg.Tx) error {
+			return nil
+		})
+		Expect(err).To(Equal(sharding.ErrNoShards))
+	})
+
+	It("clones cluster with separate params", func() {
+		clone := cluster.Clone(map[string]interface{}{
+			"app": "read",
+		})
+		Expect(clone.Shard(1).Param("app")).To(Equal("read"))
+		Expect(shardId(clone.Shard(1))).To(Equal(int64(1)))
+		Expect(clone.Shard(1).Options().Addr).To(Equal("db2"))
+		Expect(cluster.Shard(1).Param("app")).To(BeNil())
+
+		// Pools are still open for the original cluster,
+		// which is closed in AfterEach.
+		Expect(clone.Close()).NotTo(HaveOccurred())
+
+		Expect(recovered(func() {
+			cluster.Clone(map[string]interface{}{"shard": "x"})
+		})).To(Equal("sharding: param shard is reserved"))
+	})
+
+	It("returns servers in stable order", func() {
+		cl := sharding.NewCluster([]*pg.DB{db2, db1, db2, db1}, 4)
+		Expect(cl.Servers()).To(Equal([]*pg.DB{db1, db2}))
+		Expect(cl.Config().Servers[0].Addr).To(Equal("db1"))
+		Expect(cl.DBs()).To(Equal([]*pg.DB{db2, db1, db2, db1}))
+	})
+
+	It("identifies shards by ShardId", func() {
+		seen := make(map[int64]int)
+		for i := int64(0); i < 8; i++ {
+			seen[sharding.ShardId(cluster.Shard(i))]++
+		}
+		seen[sharding.ShardId(cluster.WithContext(context.Background()).Shard(1))]++
+		Expect(seen).To(Equal(map[int64]int{0: 2, 1: 3, 2: 2, 3: 2}))
+	})
+
+	It("sets extra params on every shard", func() {
+		cl := sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+			Params: map[string]interface{}{
+				"tenant_tier": "gold",
+			},
+		})
+		for i := int64(0); i < 4; i++ {
+			shard := cl.Shard(i)
+			Expect(shard.Param("tenant_tier")).To(Equal("gold"))
+			Expect(shardId(shard)).To(Equal(i))
+		}
+		Expect(db1.Param("tenant_tier")).To(BeNil())
+
+		Expect(recovered(func() {
+			sharding.NewClusterWithOptions([]*pg.DB{db1}, 1, &sharding.ClusterOptions{
+				Params: map[string]interface{}{
+					"shard": "other",
+				},
+			})
+		})).To(Equal("sharding: param shard is reserved"))
+	})
+
+	It("returns topology", func() {
+		Expect(cluster.Topology()).To(Equal([]sharding.ShardPlacement{
+			{ShardId: 0, Schema: "shard0", Server: db1},
+			{ShardId: 1, Schema: "shard1", Server: db2},
+			{ShardId: 2, Schema: "shard2", Server: db1},
+			{ShardId: 3, Schema: "shard3", Server: db2},
+		}))
+		Expect(cluster.SubCluster(1, 2).Topology()).To(Equal([]sharding.ShardPlacement{
+			{ShardId: 2, Schema: "shard2", Server: db1},
+			{ShardId: 3, Schema: "shard3", Server: db2},
+		}))
+	})
+
+	It("recreates shards with new IdGen", func() {
+		epoch := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+		gen := sharding.NewIdGen(41, 11, 12, epoch)
+		cl := cluster.WithIdGen(gen)
+
+		for i := int64(0); i < 4; i++ {
+			Expect(cl.Shard(i).Param("epoch")).To(Equal(epoch.UnixNano() / int64(time.Millisecond)))
+			Expect(cl.Shard(i).Options()).To(Equal(cluster.Shard(i).Options()))
+		}
+		Expect(cluster.Shard(0).Param("epoch")).To(Equal(int64(1262304000000)))
+
+		id := gen.NextId(time.Now(), 3, 1)
+		Expect(shardId(cl.SplitShard(id))).To(Equal(int64(3)))
+
+		Expect(recovered(func() {
+			cluster.WithIdGen(sharding.NewIdGen(62, 1, 1, epoch))
+		})).To(Equal("sharding: nshards=4 exceeds IdGen capacity 2"))
+	})
+
+	It("panics when a db is nil", func() {
+		Expect(recovered(func() {
+			sharding.NewCluster([]*pg.DB{db1, db2, nil, db2}, 4)
+		})).To(Equal("sharding: dbs[2] is nil"))
+
+		_, err := sharding.NewClusterFromSchemas(context.Background(), []*pg.DB{nil}, nil)
+		Expect(err).To(MatchError("sharding: dbs[0] is nil"))
+
+		Expect(cluster.IsServerDisabled(nil)).To(BeFalse())
+		cluster.DisableServer(nil)
+		cluster.EnableServer(nil)
+	})
+
+	It("panics when shards exceed IdGen capacity", func() {
+		gen := sharding.NewIdGen(62, 1, 1, time.Now())
+		Expect(recovered(func() {
+			sharding.NewClusterWithGen([]*pg.DB{db1}, 4, gen)
+		})).To(Equal("sharding: nshards=4 exceeds IdGen capacity 2"))
+		Expect(recovered(func() {
+			sharding.NewClusterWithGen([]*pg.DB{db1, db2, db1}, 2, gen)
+		})).To(Equal("sharding: len(dbs)=3 exceeds IdGen capacity 2"))
+	})
+
+	Describe("QuotedShardName", func() {
+		It("returns quoted schema name", func() {
+			Expect(sharding.QuotedShardName(cluster.Shard(3))).To(Equal(`"shard3"`))
+		})
+
+		It("escapes double quotes", func() {
+			Expect(sharding.QuoteIdent(`my"shard`)).To(Equal(`"my""shard"`))
+			Expect(sharding.QuoteIdent(`my.shard`)).To(Equal(`"my.shard"`))
+		})
+
+		It("formats ShardIdent as quoted identifier", func() {
+			tests := []struct {
+				name   string
+				wanted string
+			}{
+				{"shard3", `"shard3".users`},
+				{"Shard3", `"Shard3".users`},
+				{"select", `"select".users`},
+				{"USER", `"USER".users`},
+				{`my"shard`, `"my""shard".users`},
+			}
+			for _, test := range tests {
+				db := db1.WithParam("schema", sharding.ShardIdent(test.name))
+				Expect(string(db.FormatQuery(nil, "?schema.users"))).To(Equal(test.wanted))
+			}
+		})
+	})
+
+	Describe("Replicas", func() {
+		var replica2 *pg.DB
+
+		BeforeEach(func() {
+			replica2 = pg.Connect(&pg.Options{
+				Addr: "db2-replica",
+			})
+			cluster = sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+				Replicas: map[*pg.DB]*pg.DB{db2: replica2},
+			})
+		})
+
+		AfterEach(func() {
+			Expect(replica2.Close()).NotTo(HaveOccurred())
+		})
+
+		It("routes reads to replica", func() {
+			shard := cluster.ReplicaShard(3)
+			Expect(shard.Options()).To(Equal(replica2.Options()))
+			Expect(shardId(shard)).To(Equal(int64(3)))
+
+			shard = cluster.ReplicaShard(2)
+			Expect(shard.Options()).To(Equal(db1.Options()))
+		})
+
+		It("wraps numbers out of range like Shard", func() {
+			shard := cluster.ReplicaShard(-1)
+			Expect(shard.Options()).To(Equal(replica2.Options()))
+			Expect(shardId(shard)).To(Equal(int64(3)))
+			Expect(shardId(cluster.Shard(-1))).To(Equal(int64(3)))
+
+			shard = cluster.ReplicaShard(7)
+			Expect(shardId(shard)).To(Equal(int64(3)))
+		})
+
+		It("routes reads and writes", func() {
+			shard := cluster.ReadWriteShard(3)
+			Expect(shard.Replica().Options()).To(Equal(replica2.Options()))
+			Expect(shard.Primary().Options()).To(Equal(db2.Options()))
+			Expect(shardId(shard.Replica())).To(Equal(int64(3)))
+			Expect(shardId(shard.Primary())).To(Equal(int64(3)))
+
+			forced := shard.ForceWrite()
+			Expect(forced.Replica()).To(Equal(shard.Primary()))
+			Expect(forced.Primary()).To(Equal(shard.Primary()))
+
+			shard = cluster.ReadWriteShard(2)
+			Expect(shard.Replica().Options()).To(Equal(db1.Options()))
+		})
+
+		It("reports shards without replica", func() {
+			cl := sharding.NewCluster([]*pg.DB{db1, db2}, 4)
+			lag, err := cl.ReplicaLag(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lag).To(Equal(map[int64]time.Duration{
+				0: sharding.NoReplica,
+				1: sharding.NoReplica,
+				2: sharding.NoReplica,
+				3: sharding.NoReplica,
+			}))
+		})
+	})
+
+	It("escapes args that contain shard param names", func() {
+		b := cluster.Shard(3).FormatQuery(nil, `SELECT ?shard.id, ?`, "?shard ?shard_id")
+		Expect(string(b)).To(Equal(`SELECT "shard3".id, '?shard ?shard_id'`))
+	})
+
+	Describe("ShardByName", func() {
+		It("parses shard name", func() {
+			for _, name := range []string{"shard3", `"shard3"`} {
+				shard, ok := cluster.ShardByName(name)
+				Expect(ok).To(BeTrue())
+				Expect(shardId(shard)).To(Equal(int64(3)))
+			}
+		})
+
+		It("returns false for invalid names", func() {
+			names := []string{
+				"", "shard", "shard4", "shard-1", "shard+1", "shard01",
+				"shardx", "public", "shard99999999999999999999",
+			}
+			for _, name := range names {
+				shard, ok := cluster.ShardByName(name)
+				Expect(ok).To(BeFalse(), name)
+				Expect(shard).To(BeNil())
+			}
+		})
+	})
+
+	Describe("WithContext", func() {
+		It("binds shards to the context", func() {
+			type ctxKey struct{}
+			ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+			cl := cluster.WithContext(ctx)
+			Expect(cl.Context()).To(Equal(ctx))
+			Expect(cl.Shard(1).Context()).To(Equal(ctx))
+			Expect(cl.SplitShard(0).Context()).To(Equal(ctx))
+			Expect(shardId(cl.Shard(1))).To(Equal(int64(1)))
+			Expect(cluster.Shard(1).Context()).To(Equal(context.Background()))
+
+			err := cl.ForEachShard(func(shard *pg.DB) error {
+				if shard.Context() != ctx {
+					return errors.New("shard has no context")
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("stops ForEachShard when context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			var n int32
+			err := cluster.WithContext(ctx).ForEachShard(func(shard *pg.DB) error {
+				atomic.AddInt32(&n, 1)
+				return nil
+			}, sharding.WithContext(context.Background()))
+			Expect(err).To(Equal(context.Canceled))
+			Expect(n).To(BeZero())
+		})
+
+		It("shares disabled servers", func() {
+			cl := cluster.WithContext(context.Background())
+			cluster.DisableServer(db2)
+			Expect(cl.IsServerDisabled(db2)).To(BeTrue())
+		})
+	})
+
+	Describe("Tracer", func() {
+		It("creates span for ForEachShard and child span for each shard", func() {
+			tracer := new(testTracer)
+			cl := sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+				Tracer: tracer,
+			})
+
+			err := cl.ForEachShard(func(shard *pg.DB) error {
+				span := shard.Context().Value(spanKey{}).(*testSpan)
+				if span.attrs["db.shard_id"] == int64(2) {
+					return errors.New("fake error")
+				}
+				return nil
+			})
+			Expect(err).To(MatchError("fake error"))
+
+			Expect(tracer.spans).To(HaveLen(5))
+			root := tracer.spans[0]
+			Expect(root.name).To(Equal("sharding.ForEachShard"))
+			Expect(root.parent).To(BeNil())
+			Expect(root.ended).To(BeTrue())
+			Expect(root.err).To(MatchError("fake error"))
+
+			ids := make(map[interface{}]error)
+			for _, span := range tracer.spans[1:] {
+				Expect(span.name).To(Equal("sharding.shard"))
+				Expect(span.parent).To(Equal(root))
+				Expect(span.ended).To(BeTrue())
+				Expect(span.attrs["db.system"]).To(Equal("postgresql"))
+				ids[span.attrs["db.shard_id"]] = span.err
+			}
+			Expect(ids).To(HaveLen(4))
+			Expect(ids[int64(2)]).To(MatchError("fake error"))
+		})
+	})
+
+	Describe("Rebalance", func() {
+		var target *sharding.Cluster
+
+		BeforeEach(func() {
+			target = sharding.NewCluster([]*pg.DB{db1, db1, db2, db2}, 4)
+		})
+
+		It("plans moves of shards placed on other servers", func() {
+			plan, err := cluster.RebalancePlan(target)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plan).To(Equal([]sharding.ShardMove{
+				{ShardId: 1, From: db2, To: db1},
+				{ShardId: 2, From: db1, To: db2},
+			}))
+
+			_, err = cluster.RebalancePlan(sharding.NewCluster([]*pg.DB{db1}, 2))
+			Expect(err).To(MatchError("sharding: clusters have different number of shards"))
+		})
+
+		It("returns remaining moves on failure", func() {
+			plan := []sharding.ShardMove{
+				{ShardId: 0, From: db1, To: db2},
+				{ShardId: 2, From: db1, To: db2},
+			}
+
+			var moved []int64
+			var mu sync.Mutex
+			remaining, err := cluster.ApplyRebalance(context.Background(), plan, func(ctx context.Context, move sharding.ShardMove) error {
+				if move.ShardId == 2 {
+					return errors.New("fake error")
+				}
+				mu.Lock()
+				moved = append(moved, move.ShardId)
+				mu.Unlock()
+				return nil
+			})
+			Expect(err).To(MatchError("fake error"))
+			Expect(remaining).To(Equal(plan[1:]))
+			Expect(moved).To(Equal([]int64{0}))
+
+			remaining, err = cluster.ApplyRebalance(context.Background(), remaining, func(ctx context.Context, move sharding.ShardMove) error {
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(remaining).To(BeEmpty())
+		})
+
+		It("cancels running moves on failure", func() {
+			plan := []sharding.ShardMove{
+				{ShardId: 0, From: db1, To: db2},
+				{ShardId: 1, From: db2, To: db1},
+			}
+
+			started := make(chan struct{})
+			remaining, err := cluster.ApplyRebalance(context.Background(), plan, func(ctx context.Context, move sharding.ShardMove) error {
+				if move.ShardId == 0 {
+					<-started
+					return errors.New("fake error")
+				}
+				close(started)
+				<-ctx.Done()
+				return ctx.Err()
+			})
+			Expect(err).To(MatchError("fake error"))
+			Expect(remaining).To(Equal(plan))
+		})
+	})
+
+	Describe("ConsistentHashing", func() {
+		var dbs []*pg.DB
+
+		BeforeEach(func() {
+			dbs = []*pg.DB{db1, db2}
+			for _, addr := range []string{"db3", "db4"} {
+				dbs = append(dbs, pg.Connect(&pg.Options{
+					Addr: addr,
+				}))
+			}
+		})
+
+		AfterEach(func() {
+			for _, db := range dbs[2:] {
+				Expect(db.Close()).NotTo(HaveOccurred())
+			}
+		})
+
+		newCluster := func(dbs ...*pg.DB) *sharding.Cluster {
+			return sharding.NewClusterWithOptions(dbs, 64, &sharding.ClusterOptions{
+				ConsistentHashing: true,
+			})
+		}
+
+		It("moves shards only onto added servers", func() {
+			cl := newCluster(dbs[0], dbs[1])
+			target := newCluster(dbs...)
+
+			counts := cl.ShardCountPerServer()
+			Expect(counts).To(HaveLen(2))
+			Expect(counts[db1] + counts[db2]).To(Equal(64))
+
+			plan, err := cl.RebalancePlan(target)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plan).NotTo(BeEmpty())
+			for _, move := range plan {
+				Expect([]*pg.DB{dbs[2], dbs[3]}).To(ContainElement(move.To))
+			}
+
+			for i := int64(0); i < 64; i++ {
+				Expect(cl.DB(i).Options()).To(Equal(cl.Shard(i).Options()))
+			}
+		})
+
+		It("does not depend on dbs order", func() {
+			cl1 := newCluster(dbs...)
+			cl2 := newCluster(dbs[3], dbs[1], dbs[2], dbs[0])
+			for i := int64(0); i < 64; i++ {
+				Expect(cl1.Shard(i).Options()).To(Equal(cl2.Shard(i).Options()))
+			}
+		})
+
+		It("round-trips through config", func() {
+			cl := newCluster(dbs...)
+			cfg := cl.Config()
+			Expect(cfg.ConsistentHashing).To(BeTrue())
+
+			cl2, err := sharding.NewClusterFromConfig(cfg, func(server sharding.ServerConfig) *pg.DB {
+				return pg.Connect(&pg.Options{
+					Addr: server.Addr,
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer cl2.Close()
+			Expect(cl2.Config()).To(Equal(cfg))
+		})
 	})
 
-	It("supports ?shard_id", func() {
-		var shardId int
-		_, err := cluster.Shard(3).QueryOne(pg.Scan(&shardId), "SELECT ?shard_id")
+	It("rechecks unreachable servers", func() {
+		var up int32
+		down := pg.Connect(&pg.Options{
+			Addr: "down",
+			Dialer: func(network, addr string) (net.Conn, error) {
+				if atomic.LoadInt32(&up) == 0 {
+					return nil, errors.New("fake dial error")
+				}
+				return sharding.StubDialer(network, addr)
+			},
+		})
+		cl := sharding.NewClusterWithOptions([]*pg.DB{sharding.NewStubDB("up"), down}, 4, &sharding.ClusterOptions{
+			AllowPartial: true,
+			PingTimeout:  time.Second,
+		})
+		defer cl.Close()
+		Expect(cl.UnreachableServers()).To(HaveKey(down))
+
+		Expect(cl.RecheckServers(context.Background())).To(HaveKey(down))
+		err := cl.ForEachShard(func(shard *pg.DB) error {
+			return nil
+		})
+		Expect(err).To(Equal(sharding.ErrServerUnreachable))
+
+		atomic.StoreInt32(&up, 1)
+		Expect(cl.RecheckServers(context.Background())).To(BeEmpty())
+		Expect(cl.UnreachableServers()).To(BeEmpty())
+		err = cl.ForEachShard(func(shard *pg.DB) error {
+			return nil
+		})
 		Expect(err).NotTo(HaveOccurred())
-		Expect(shardId).To(Equal(3))
 	})
 
-	It("supports ?epoch", func() {
-		var epoch int64
-		_, err := cluster.Shard(0).QueryOne(pg.Scan(&epoch), "SELECT ?epoch")
+	It("bounds startup ping with PingTimeout", func() {
+		hang := pg.Connect(&pg.Options{
+			Addr: "hang",
+			Dialer: func(network, addr string) (net.Conn, error) {
+				// The server accepts the connection, but never responds.
+				client, server := net.Pipe()
+				go io.Copy(ioutil.Discard, server)
+				return client, nil
+			},
+		})
+		start := time.Now()
+		cl := sharding.NewClusterWithOptions([]*pg.DB{sharding.NewStubDB("up"), hang}, 4, &sharding.ClusterOptions{
+			AllowPartial: true,
+			PingTimeout:  50 * time.Millisecond,
+		})
+		defer cl.Close()
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(cl.UnreachableServers()[hang]).To(Equal(context.DeadlineExceeded))
+	})
+
+	It("panics with AllowPartial when all servers are unreachable", func() {
+		v := recovered(func() {
+			sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+				AllowPartial: true,
+			})
+		})
+		Expect(v).To(HavePrefix("sharding: all servers are unreachable"))
+	})
+
+	It("executes statement once on each server", func() {
+		results, err := cluster.ExecOnServers(`SELECT 1`)
+		Expect(results).To(BeEmpty())
+		Expect(err).To(HaveOccurred())
+
+		serversErr := err.(*sharding.ServersError)
+		Expect(serversErr.Errors).To(HaveLen(2))
+		Expect(serversErr.Errors).To(HaveKey(db1))
+		Expect(serversErr.Errors).To(HaveKey(db2))
+		Expect(err.Error()).To(HavePrefix("sharding: statement failed on 2 server(s): tcp://@db1/: "))
+	})
+
+	Describe("ClusterHealthHandler", func() {
+		It("reports unreachable servers", func() {
+			handler := sharding.ClusterHealthHandler(cluster, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+			Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+
+			var resp struct {
+				Healthy bool `json:"healthy"`
+				Servers []struct {
+					Addr    string `json:"addr"`
+					Healthy bool   `json:"healthy"`
+					Error   string `json:"error"`
+				} `json:"servers"`
+			}
+			Expect(json.Unmarshal(w.Body.Bytes(), &resp)).NotTo(HaveOccurred())
+			Expect(resp.Healthy).To(BeFalse())
+			Expect(resp.Servers).To(HaveLen(2))
+			Expect(resp.Servers[0].Addr).To(Equal("db1"))
+			Expect(resp.Servers[0].Healthy).To(BeFalse())
+			Expect(resp.Servers[0].Error).NotTo(BeEmpty())
+			Expect(resp.Servers[1].Addr).To(Equal("db2"))
+		})
+
+		It("does not modify options", func() {
+			opt := &sharding.HealthHandlerOptions{}
+			sharding.ClusterHealthHandler(cluster, opt)
+			Expect(*opt).To(Equal(sharding.HealthHandlerOptions{}))
+		})
+	})
+
+	Describe("StablePlacement", func() {
+		It("does not depend on dbs order", func() {
+			opt := &sharding.ClusterOptions{
+				StablePlacement: true,
+			}
+			cl1 := sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, opt)
+			cl2 := sharding.NewClusterWithOptions([]*pg.DB{db2, db1}, 4, opt)
+			for i := int64(0); i < 4; i++ {
+				Expect(cl1.Shard(i).Options()).To(Equal(cl2.Shard(i).Options()))
+			}
+			Expect(cl1.Shard(0).Options()).To(Equal(db1.Options()))
+			Expect(cl1.Shard(1).Options()).To(Equal(db2.Options()))
+		})
+	})
+
+	It("groups ids by shard", func() {
+		gen := sharding.DefaultIdGen
+		tm := time.Now()
+		ids := []int64{
+			gen.NextId(tm, 1, 1),
+			gen.NextId(tm, 2, 1),
+			gen.NextId(tm, 5, 2),
+			gen.NextId(tm, 1, 3),
+		}
+		Expect(cluster.GroupByShard(ids)).To(Equal(map[int64][]int64{
+			1: {ids[0], ids[2], ids[3]},
+			2: {ids[1]},
+		}))
+	})
+
+	It("splits shards of ids in batch", func() {
+		gen := sharding.DefaultIdGen
+		tm := time.Now()
+		ids := []int64{gen.NextId(tm, 3, 1), -1, gen.NextId(tm, 5, 1)}
+		shards, errs := cluster.SplitShardBatch(ids)
+		Expect(shards).To(HaveLen(3))
+		Expect(errs).To(HaveLen(3))
+
+		Expect(shardId(shards[0])).To(Equal(int64(3)))
+		Expect(errs[0]).NotTo(HaveOccurred())
+
+		Expect(shards[1]).To(BeNil())
+		Expect(errs[1]).To(MatchError("sharding: id -1 is negative"))
+
+		Expect(shards[2]).To(BeNil())
+		Expect(errs[2]).To(MatchError(fmt.Sprintf(
+			"sharding: id %d has shard 5, cluster has 4 shards", ids[2])))
+	})
+
+	It("freezes routing in snapshot", func() {
+		ro := pg.Connect(&pg.Options{
+			Addr: "db2-ro",
+		})
+		defer ro.Close()
+
+		snapshot := cluster.Snapshot()
+		cluster.DisableServerReadOnly(db2, ro)
+		Expect(cluster.Shard(1).Options()).To(Equal(ro.Options()))
+		Expect(snapshot.Shard(1).Options()).To(Equal(db2.Options()))
+		Expect(snapshot.IsServerDisabled(db2)).To(BeFalse())
+
+		var mu sync.Mutex
+		var ids []int64
+		err := snapshot.ForEachShard(func(shard *pg.DB) error {
+			mu.Lock()
+			ids = append(ids, shardId(shard))
+			mu.Unlock()
+			return nil
+		})
 		Expect(err).NotTo(HaveOccurred())
-		Expect(epoch).To(Equal(int64(1262304000000)))
+		Expect(ids).To(ConsistOf(int64(0), int64(1), int64(2), int64(3)))
+
+		snapshot = cluster.Snapshot()
+		cluster.EnableServer(db2)
+		Expect(snapshot.SplitShard(sharding.DefaultIdGen.NextId(time.Now(), 3, 1)).Options()).
+			To(Equal(ro.Options()))
+		Expect(snapshot.Shards(db2)).To(HaveLen(2))
+		Expect(snapshot.IsServerDisabled(db2)).To(BeTrue())
+	})
+
+	It("describes topology", func() {
+		Expect(cluster.String()).To(Equal("Cluster<4 shards, 2 servers, 2 shards per server>"))
+		Expect(fmt.Sprint(cluster)).To(Equal(cluster.String()))
+
+		cluster.DisableServer(db2)
+		Expect(cluster.Describe()).To(Equal(
+			"db1: shards 0, 2\n" +
+				"db2: shards 1, 3 (disabled)\n"))
+
+		cl := sharding.NewCluster([]*pg.DB{db1, db1, db2}, 6)
+		Expect(cl.String()).To(Equal("Cluster<6 shards, 2 servers, 2-4 shards per server>"))
+		Expect(cl.Describe()).To(Equal(
+			"db1: shards 0-1, 3-4\n" +
+				"db2: shards 2, 5\n"))
 	})
 
-	It("supports UUID", func() {
-		src := sharding.NewUUID(1234, time.Unix(math.MaxInt64, 0))
-		var dst sharding.UUID
-		_, err := cluster.Shard(3).QueryOne(pg.Scan(&dst), `SELECT ?`, src)
+	It("routes string ids", func() {
+		id := sharding.DefaultIdGen.NextId(time.Now(), 3, 1)
+		shard, err := cluster.ShardForIdString(strconv.FormatInt(id, 10))
 		Expect(err).NotTo(HaveOccurred())
-		Expect(dst).To(Equal(src))
+		Expect(shardId(shard)).To(Equal(int64(3)))
+
+		for _, s := range []string{"", "abc", "1.5", "99999999999999999999"} {
+			_, err := cluster.ShardForIdString(s)
+			Expect(err).To(MatchError(fmt.Sprintf("sharding: invalid id %q", s)))
+		}
 	})
-})
 
-var _ = Describe("Cluster", func() {
-	var db1, db2 *pg.DB
-	var cluster *sharding.Cluster
+	It("routes ids with RouteOverride", func() {
+		gen := sharding.DefaultIdGen
+		vip := gen.NextId(time.Now(), 1, 1)
+		cl := sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+			RouteOverride: func(id int64) (int64, bool) {
+				return 3, id == vip
+			},
+		})
+
+		Expect(shardId(cl.SplitShard(vip))).To(Equal(int64(3)))
+		Expect(shardId(cl.SplitShard(vip + 1))).To(Equal(int64(1)))
+		Expect(cl.GroupByShard([]int64{vip, vip + 1})).To(Equal(map[int64][]int64{
+			1: {vip + 1},
+			3: {vip},
+		}))
+	})
+
+	It("routes unresolvable ids to the fallback shard", func() {
+		gen := sharding.DefaultIdGen
+		legacy := gen.NextId(time.Now(), 5, 1)
+		valid := gen.NextId(time.Now(), 1, 1)
+
+		var fallbacks []int64
+		cl := sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+			Fallback: &sharding.FallbackOptions{
+				ShardId: 3,
+				OnFallback: func(id, shardId int64) {
+					Expect(shardId).To(Equal(int64(5)))
+					fallbacks = append(fallbacks, id)
+				},
+			},
+		})
+
+		Expect(shardId(cl.SplitShard(legacy))).To(Equal(int64(3)))
+		Expect(shardId(cl.SplitShard(valid))).To(Equal(int64(1)))
+
+		shards, errs := cl.SplitShardBatch([]int64{legacy, valid})
+		Expect(errs).To(Equal([]error{nil, nil}))
+		Expect(shardId(shards[0])).To(Equal(int64(3)))
+		Expect(shardId(shards[1])).To(Equal(int64(1)))
+
+		Expect(fallbacks).To(Equal([]int64{legacy, legacy}))
+	})
+
+	It("panics when the fallback shard is out of range", func() {
+		Expect(recovered(func() {
+			sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+				Fallback: &sharding.FallbackOptions{ShardId: 4},
+			})
+		})).To(Equal("sharding: fallback shard 4 is out of range of 4 shards"))
+	})
+
+	Describe("ShardForKey", func() {
+		It("routes same key to same shard", func() {
+			shard := cluster.ShardForKey("user@example.com")
+			Expect(cluster.ShardForKey("user@example.com")).To(Equal(shard))
+		})
+
+		It("uses custom hash", func() {
+			cluster = sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+				Hash: func(key []byte) uint64 {
+					return uint64(len(key))
+				},
+			})
+			for _, key := range []string{"", "a", "ab", "abc", "abcd", "abcde"} {
+				shard := cluster.ShardForKey(key)
+				Expect(shardId(shard)).To(Equal(int64(len(key) % 4)))
+			}
+		})
+	})
+
+	Describe("ShardForBytes", func() {
+		It("routes same bytes as ShardForKey", func() {
+			for _, key := range []string{"", "a", "user@example.com"} {
+				Expect(cluster.ShardForBytes([]byte(key))).To(Equal(cluster.ShardForKey(key)))
+			}
+		})
+
+		It("routes composite keys", func() {
+			cluster = sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+				Hash: func(key []byte) uint64 {
+					return uint64(len(key))
+				},
+			})
+			key := sharding.CompositeKey(int64(42), "eu")
+			Expect(string(key)).To(Equal("2:422:eu"))
+			Expect(shardId(cluster.ShardForBytes(key))).To(Equal(int64(0)))
+
+			Expect(sharding.CompositeKey("ab", "c")).NotTo(Equal(sharding.CompositeKey("a", "bc")))
+		})
+
+		It("reduces hash by number of shards", func() {
+			cluster = sharding.NewClusterWithOptions([]*pg.DB{db1}, 3, &sharding.ClusterOptions{
+				Hash: func(key []byte) uint64 {
+					return 2050
+				},
+			})
+			Expect(shardId(cluster.ShardForKey("key"))).To(Equal(int64(2050 % 3)))
+		})
+	})
+
+	Describe("ShardForTime", func() {
+		It("routes weeks since epoch to shards", func() {
+			epoch := time.Unix(0, 0)
+			week := 7 * 24 * time.Hour
+			for i := 0; i < 8; i++ {
+				tm := epoch.Add(time.Duration(i)*week + time.Hour)
+				Expect(shardId(cluster.ShardForTime(tm))).To(Equal(int64(i % 4)))
+			}
+			Expect(shardId(cluster.ShardForTime(epoch.Add(-time.Hour)))).To(Equal(int64(3)))
+		})
+
+		It("uses custom time bucket", func() {
+			cluster = sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+				TimeBucket: func(tm time.Time) int64 {
+					return int64(tm.Month())
+				},
+			})
+			tm := time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC)
+			Expect(shardId(cluster.ShardForTime(tm))).To(Equal(int64(3)))
+		})
+
+		It("routes buckets round-robin when shards do not divide IdGen capacity", func() {
+			var bucket int64
+			cluster = sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 6, &sharding.ClusterOptions{
+				TimeBucket: func(tm time.Time) int64 {
+					return bucket
+				},
+			})
+			for b, want := range map[int64]int64{2046: 0, 2047: 1, 2048: 2, -1: 5} {
+				bucket = b
+				Expect(shardId(cluster.ShardForTime(time.Now()))).To(Equal(want))
+			}
+		})
+	})
+
+	Describe("DisableServer", func() {
+		var ro *pg.DB
+
+		BeforeEach(func() {
+			ro = pg.Connect(&pg.Options{
+				Addr: "db2-readonly",
+			})
+			cluster.DisableServerReadOnly(db2, ro)
+		})
+
+		AfterEach(func() {
+			Expect(ro.Close()).NotTo(HaveOccurred())
+		})
+
+		It("routes shards on disabled server to read-only db", func() {
+			Expect(cluster.IsServerDisabled(db2)).To(BeTrue())
+
+			shard := cluster.Shard(1)
+			Expect(shard.Options()).To(Equal(ro.Options()))
+			Expect(shardId(shard)).To(Equal(int64(1)))
+
+			shard = cluster.Shard(2)
+			Expect(shard.Options()).To(Equal(db1.Options()))
+
+			cluster.EnableServer(db2)
+			Expect(cluster.IsServerDisabled(db2)).To(BeFalse())
+
+			shard = cluster.Shard(1)
+			Expect(shard.Options()).To(Equal(db2.Options()))
+		})
+
+		It("routes shards to read-only pool without read-only db", func() {
+			cluster.DisableServer(db1)
+			Expect(cluster.IsServerDisabled(db1)).To(BeTrue())
+
+			shard := cluster.Shard(2)
+			Expect(shardId(shard)).To(Equal(int64(2)))
+			Expect(shard.Options().Addr).To(Equal("db1"))
+			Expect(shard.Options().OnConnect).NotTo(BeNil())
+			Expect(cluster.Shard(0).Options()).To(Equal(shard.Options()))
+
+			cluster.EnableServer(db1)
+			cluster.DisableServer(db1)
+			Expect(cluster.Shard(2).Options()).To(Equal(shard.Options()))
+
+			Expect(recovered(func() {
+				cluster.DisableServerReadOnly(db1, nil)
+			})).To(Equal("sharding: DisableServerReadOnly is called with nil readOnly"))
+		})
+
+		It("skips disabled server in ForEachShard", func() {
+			var shards []int64
+			var mu sync.Mutex
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				mu.Lock()
+				shards = append(shards, shardId(shard))
+				mu.Unlock()
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shards).To(ConsistOf(int64(0), int64(2)))
+
+			shards = shards[:0]
+			err = cluster.ForEachShard(func(shard *pg.DB) error {
+				mu.Lock()
+				shards = append(shards, shardId(shard))
+				mu.Unlock()
+				return nil
+			}, sharding.WithDisabled())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shards).To(ConsistOf(int64(0), int64(1), int64(2), int64(3)))
+		})
+
+		It("does not write to shards on disabled server", func() {
+			stub1, stub2 := sharding.NewStubDB("stub1"), sharding.NewStubDB("stub2")
+			cl := sharding.NewCluster([]*pg.DB{stub1, stub2}, 4)
+			defer cl.Close()
+			cl.DisableServer(stub2)
+
+			gen := sharding.DefaultIdGen
+			ids := []int64{gen.NextId(time.Now(), 0, 1), gen.NextId(time.Now(), 1, 1)}
+			_, err := cl.DeleteByIds(context.Background(), "users", ids)
+			Expect(err).To(Equal(&sharding.ShardError{ShardId: 1, Err: sharding.ErrServerDisabled}))
+
+			_, err = cl.ExecOneForEachShard(`UPDATE users SET name = 'x' WHERE id = 1`)
+			Expect(errors.Is(err, sharding.ErrServerDisabled)).To(BeTrue())
+		})
+
+		It("is safe to toggle while shards are iterated", func() {
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				for i := 0; i < 100; i++ {
+					cluster.EnableServer(db2)
+					cluster.DisableServerReadOnly(db2, ro)
+				}
+			}()
+
+			for i := 0; i < 100; i++ {
+				err := cluster.ForEachShard(func(shard *pg.DB) error {
+					defer GinkgoRecover()
+					Expect(cluster.Shard(shardId(shard))).NotTo(BeNil())
+					return nil
+				}, sharding.WithDisabled(), sharding.WithConcurrency(2))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cluster.SplitShard(int64(i))).NotTo(BeNil())
+			}
+			<-done
+		})
+	})
+
+	It("panics when SearchPath needs more connections than PoolSize", func() {
+		db := pg.Connect(&pg.Options{
+			Addr:     "db3",
+			PoolSize: 2,
+		})
+		defer db.Close()
+		v := recovered(func() {
+			sharding.NewClusterWithOptions([]*pg.DB{db}, 4, &sharding.ClusterOptions{
+				SearchPath: true,
+			})
+		})
+		Expect(v).To(Equal(
+			"sharding: SearchPath needs a connection per shard, but tcp://@db3/ has 4 shards and PoolSize=2"))
+	})
+
+	It("panics when fn is nil", func() {
+		Expect(recovered(func() {
+			cluster.ForEachDB(nil)
+		})).To(Equal("sharding: ForEachDB is called with nil fn"))
+		Expect(recovered(func() {
+			cluster.ForEachShard(nil)
+		})).To(Equal("sharding: ForEachShard is called with nil fn"))
+		Expect(recovered(func() {
+			cluster.ForEachNShards(2, nil)
+		})).To(Equal("sharding: ForEachNShards is called with nil fn"))
+		Expect(recovered(func() {
+			cluster.SubCluster(0, 2).ForEachShard(nil)
+		})).To(Equal("sharding: ForEachShard is called with nil fn"))
+	})
+
+	Describe("ForEachShard options", func() {
+		It("limits concurrency per server", func() {
+			cluster = sharding.NewCluster([]*pg.DB{db1, db2}, 8)
+			for _, concurrency := range []int{1, 2, 4} {
+				var active, maxActive int32
+				err := cluster.ForEachShard(func(shard *pg.DB) error {
+					n := atomic.AddInt32(&active, 1)
+					for {
+						max := atomic.LoadInt32(&maxActive)
+						if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+							break
+						}
+					}
+					time.Sleep(10 * time.Millisecond)
+					atomic.AddInt32(&active, -1)
+					return nil
+				}, sharding.WithConcurrency(concurrency))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(maxActive).To(Equal(int32(2 * concurrency)))
+			}
+		})
+
+		It("observes duration of every shard", func() {
+			var mu sync.Mutex
+			durs := make(map[int64]time.Duration)
+			errs := make(map[int64]error)
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				id := shardId(shard)
+				time.Sleep(time.Duration(id*20) * time.Millisecond)
+				if id == 1 {
+					return errors.New("fake error")
+				}
+				return nil
+			}, sharding.WithConcurrency(2), sharding.WithObserver(
+				func(shardId int64, dur time.Duration, err error) {
+					mu.Lock()
+					durs[shardId] = dur
+					errs[shardId] = err
+					mu.Unlock()
+				}))
+			Expect(err).To(MatchError("fake error"))
 
-	BeforeEach(func() {
-		db1 = pg.Connect(&pg.Options{
-			Addr: "db1",
-		})
-		db2 = pg.Connect(&pg.Options{
-			Addr: "db2",
+			Expect(durs).To(HaveLen(4))
+			for id := int64(0); id < 4; id++ {
+				Expect(durs[id]).To(BeNumerically(">=", time.Duration(id*20)*time.Millisecond))
+				Expect(durs[id]).To(BeNumerically("<", time.Duration(id*20+50)*time.Millisecond))
+			}
+			Expect(errs[1]).To(MatchError("fake error"))
+			Expect(errs[3]).NotTo(HaveOccurred())
 		})
-		Expect(db1).NotTo(Equal(db2))
-		cluster = sharding.NewCluster([]*pg.DB{db1, db2, db1, db2}, 4)
-	})
 
-	AfterEach(func() {
-		Expect(cluster.Close()).NotTo(HaveOccurred())
-	})
+		It("limits rate of shards across servers", func() {
+			cluster = sharding.NewCluster([]*pg.DB{db1, db2}, 8)
+			start := time.Now()
+			var n int32
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				atomic.AddInt32(&n, 1)
+				return nil
+			}, sharding.WithConcurrency(4), sharding.WithRateLimit(sharding.RateLimit{
+				Rate: 100,
+			}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int32(8)))
+			Expect(time.Since(start)).To(BeNumerically(">=", 60*time.Millisecond))
 
-	It("distributes shards on servers", func() {
-		var dbs []*pg.DB
-		for i := 0; i < 16; i++ {
-			db := pg.Connect(&pg.Options{
-				Addr: fmt.Sprintf("db%d", i),
-			})
-			dbs = append(dbs, db)
-		}
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start = time.Now()
+			err = cluster.ForEachShard(func(shard *pg.DB) error {
+				return nil
+			}, sharding.WithContext(ctx), sharding.WithRateLimit(sharding.RateLimit{
+				Rate: 1,
+			}))
+			Expect(err).To(Equal(context.DeadlineExceeded))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
 
-		tests := []struct {
-			dbs    []int
-			db     int
-			shards []int64
-		}{
-			{[]int{0}, 0, []int64{0, 1, 2, 3, 4, 5, 6, 7}},
+		It("shares semaphore between calls", func() {
+			cluster = sharding.NewCluster([]*pg.DB{db1, db2}, 8)
+			sem := make(chan struct{}, 3)
+			var active, maxActive int32
+			fn := func(shard *pg.DB) error {
+				n := atomic.AddInt32(&active, 1)
+				for {
+					max := atomic.LoadInt32(&maxActive)
+					if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&active, -1)
+				return nil
+			}
 
-			{[]int{0, 1}, 0, []int64{0, 2, 4, 6}},
-			{[]int{0, 1}, 1, []int64{1, 3, 5, 7}},
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					err := cluster.ForEachShard(
+						fn, sharding.WithConcurrency(4), sharding.WithSemaphore(sem))
+					Expect(err).NotTo(HaveOccurred())
+				}()
+			}
+			wg.Wait()
+			Expect(maxActive).To(Equal(int32(3)))
+		})
 
-			{[]int{0, 1, 2, 3}, 0, []int64{0, 4}},
-			{[]int{0, 1, 2, 3}, 1, []int64{1, 5}},
-			{[]int{0, 1, 2, 3}, 2, []int64{2, 6}},
-			{[]int{0, 1, 2, 3}, 3, []int64{3, 7}},
+		It("stops on error", func() {
+			var n int32
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				atomic.AddInt32(&n, 1)
+				if shardId(shard) == 0 {
+					return errors.New("fake error")
+				}
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			}, sharding.WithStopOnError())
+			Expect(err).To(MatchError("fake error"))
+			Expect(n).To(BeNumerically("<", 4))
+		})
 
-			{[]int{0, 1, 2, 1}, 0, []int64{0, 4}},
-			{[]int{0, 1, 2, 1}, 1, []int64{1, 3, 5, 7}},
-			{[]int{0, 1, 2, 1}, 2, []int64{2, 6}},
+		It("continues on error and combines errors", func() {
+			var n int32
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				atomic.AddInt32(&n, 1)
+				if id := shardId(shard); id%2 == 1 {
+					return fmt.Errorf("fake error %d", id)
+				}
+				return nil
+			}, sharding.WithContinueOnError(), sharding.WithStopOnError())
+			Expect(n).To(Equal(int32(4)))
+			Expect(err).To(MatchError(
+				"sharding: 2 shard(s) failed: shard1: fake error 1; shard3: fake error 3"))
 
-			{[]int{0, 1, 2, 3}, 0, []int64{0, 4}},
-			{[]int{0, 1, 2, 3}, 1, []int64{1, 5}},
-			{[]int{0, 1, 2, 3}, 2, []int64{2, 6}},
-			{[]int{0, 1, 2, 3}, 3, []int64{3, 7}},
-		}
-		for _, test := range tests {
-			var cldbs []*pg.DB
-			for _, ind := range test.dbs {
-				cldbs = append(cldbs, dbs[ind])
-			}
-			cluster = sharding.NewCluster(cldbs, 8)
+			shardsErr := err.(*sharding.ShardsError)
+			Expect(shardsErr.Errors).To(HaveLen(2))
+			Expect(shardsErr.Errors[0].ShardId).To(Equal(int64(1)))
+			Expect(shardsErr.Errors[1].ShardId).To(Equal(int64(3)))
 
-			var shardIds []int64
-			for _, shard := range cluster.Shards(dbs[test.db]) {
-				shardIds = append(shardIds, shardId(shard))
-			}
-			Expect(shardIds).To(Equal(test.shards))
-		}
-	})
+			err = cluster.ForEachShard(func(shard *pg.DB) error {
+				return nil
+			}, sharding.WithContinueOnError())
+			Expect(err).NotTo(HaveOccurred())
+		})
 
-	It("distributes projects on different servers", func() {
-		tests := []struct {
-			projectId int64
-			wanted    *pg.DB
-		}{
-			{0, db1},
-			{1, db2},
-			{2, db1},
-			{3, db2},
-			{4, db1},
-		}
+		It("respects context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
 
-		for _, test := range tests {
-			shard := cluster.Shard(test.projectId)
-			Expect(shard.Options()).To(Equal(test.wanted.Options()))
-		}
-	})
+			var n int32
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				atomic.AddInt32(&n, 1)
+				return nil
+			}, sharding.WithContext(ctx))
+			Expect(err).To(Equal(context.Canceled))
+			Expect(n).To(Equal(int32(0)))
+		})
 
-	Describe("ForEachDB", func() {
-		It("fn is called once for every database", func() {
-			var dbs []*pg.DB
+		It("retries fn", func() {
 			var mu sync.Mutex
-			err := cluster.ForEachDB(func(db *pg.DB) error {
-				defer GinkgoRecover()
+			attempts := make(map[int64]int)
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
 				mu.Lock()
-				Expect(dbs).NotTo(ContainElement(db))
-				dbs = append(dbs, db)
-				mu.Unlock()
+				defer mu.Unlock()
+				attempts[shardId(shard)]++
+				if attempts[shardId(shard)] < 3 {
+					return errors.New("fake error")
+				}
 				return nil
-			})
+			}, sharding.WithRetry(2, time.Millisecond))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(dbs).To(HaveLen(2))
+			Expect(attempts).To(Equal(map[int64]int{0: 3, 1: 3, 2: 3, 3: 3}))
+
+			err = cluster.ForEachShard(func(shard *pg.DB) error {
+				return errors.New("fake error")
+			}, sharding.WithRetry(1, 0))
+			Expect(err).To(MatchError("fake error"))
 		})
 
-		It("returns an error if fn fails", func() {
-			err := cluster.ForEachDB(func(db *pg.DB) error {
-				if db == db2 {
+		It("retries fn without waiting with nil backoff", func() {
+			var calls int32
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				atomic.AddInt32(&calls, 1)
+				return errors.New("fake error")
+			}, sharding.WithRetryBackoff(1, nil))
+			Expect(err).To(MatchError("fake error"))
+			Expect(calls).To(Equal(int32(8)))
+		})
+
+		It("reports progress", func() {
+			var progress []string
+			report := func(completed, total int) {
+				progress = append(progress, fmt.Sprintf("%d/%d", completed, total))
+			}
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				if shardId(shard) == 1 {
 					return errors.New("fake error")
 				}
 				return nil
-			})
+			}, sharding.WithProgress(report), sharding.WithConcurrency(2))
+			Expect(err).To(MatchError("fake error"))
+			Expect(progress).To(Equal([]string{"1/4", "2/4", "3/4", "4/4"}))
+
+			progress = nil
+			cluster.DisableServer(db2)
+			err = cluster.ForEachShard(func(shard *pg.DB) error {
+				return nil
+			}, sharding.WithProgress(report))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(progress).To(Equal([]string{"1/2", "2/2"}))
+		})
+
+		It("gives up reconnecting when server does not come back", func() {
+			var calls int32
+			stats := new(sharding.ReconnectStats)
+			err := cluster.ForEachShard(func(shard *pg.DB) error {
+				atomic.AddInt32(&calls, 1)
+				return io.EOF
+			}, sharding.WithReconnect(2, sharding.ConstantBackoff(time.Millisecond), stats))
+			Expect(err).To(Equal(io.EOF))
+			Expect(calls).To(Equal(int32(4)))
+			Expect(stats.Retries()).To(BeEmpty())
+
+			calls = 0
+			err = cluster.ForEachShard(func(shard *pg.DB) error {
+				atomic.AddInt32(&calls, 1)
+				return errors.New("fake error")
+			}, sharding.WithReconnect(2, nil, nil))
 			Expect(err).To(MatchError("fake error"))
+			Expect(calls).To(Equal(int32(4)))
 		})
 	})
 
-	Describe("ForEachShard", func() {
-		It("fn is called once for every shard", func() {
-			var shards []int64
+	Describe("CircuitBreaker", func() {
+		connErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+		BeforeEach(func() {
+			cluster = sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+				CircuitBreaker: &sharding.CircuitBreakerOptions{
+					MaxFailures: 2,
+					Cooldown:    50 * time.Millisecond,
+				},
+			})
+		})
+
+		It("short-circuits failing server", func() {
 			var mu sync.Mutex
-			err := cluster.ForEachShard(func(shard *pg.DB) error {
-				defer GinkgoRecover()
+			var calls []int64
+			failDB2 := func(shard *pg.DB) error {
+				mu.Lock()
+				calls = append(calls, shardId(shard))
+				mu.Unlock()
+				if shard.Options() == db2.Options() {
+					return connErr
+				}
+				return nil
+			}
 
+			err := cluster.ForEachShard(failDB2)
+			Expect(err).To(MatchError(connErr))
+			Expect(calls).To(ConsistOf(int64(0), int64(1), int64(2), int64(3)))
+			Expect(cluster.OpenCircuits()).To(Equal([]*pg.DB{db2}))
+
+			calls = calls[:0]
+			err = cluster.ForEachShard(failDB2)
+			Expect(err).To(Equal(sharding.ErrCircuitOpen))
+			Expect(calls).To(ConsistOf(int64(0), int64(2)))
+
+			time.Sleep(60 * time.Millisecond)
+			calls = calls[:0]
+			err = cluster.ForEachShard(func(shard *pg.DB) error {
 				mu.Lock()
-				Expect(shards).NotTo(ContainElement(shardId))
-				shards = append(shards, shardId(shard))
+				calls = append(calls, shardId(shard))
 				mu.Unlock()
 				return nil
 			})
 			Expect(err).NotTo(HaveOccurred())
-			Expect(shards).To(HaveLen(4))
-			for shardId := int64(0); shardId < 4; shardId++ {
-				Expect(shards).To(ContainElement(shardId))
+			Expect(calls).To(ConsistOf(int64(0), int64(1), int64(2), int64(3)))
+			Expect(cluster.OpenCircuits()).To(BeEmpty())
+		})
+
+		It("uses backoff for cooldown", func() {
+			cl := sharding.NewClusterWithOptions([]*pg.DB{db1}, 1, &sharding.ClusterOptions{
+				CircuitBreaker: &sharding.CircuitBreakerOptions{
+					MaxFailures: 1,
+					Backoff:     sharding.ExponentialBackoff(40*time.Millisecond, time.Second),
+				},
+			})
+			fail := func(shard *pg.DB) error {
+				return connErr
 			}
+
+			Expect(cl.ForEachShard(fail)).To(MatchError(connErr))
+			Expect(cl.OpenCircuits()).To(Equal([]*pg.DB{db1}))
+
+			time.Sleep(50 * time.Millisecond)
+			Expect(cl.ForEachShard(fail)).To(MatchError(connErr))
+
+			time.Sleep(50 * time.Millisecond)
+			Expect(cl.ForEachShard(fail)).To(Equal(sharding.ErrCircuitOpen))
 		})
 
-		It("returns an error if fn fails", func() {
-			err := cluster.ForEachShard(func(shard *pg.DB) error {
-				if shardId(shard) == 3 {
-					return errors.New("fake error")
-				}
+		It("closes circuit when probe fails with application error", func() {
+			opt := &sharding.CircuitBreakerOptions{
+				MaxFailures: 1,
+				Cooldown:    20 * time.Millisecond,
+			}
+			cl := sharding.NewClusterWithOptions([]*pg.DB{db1}, 1, &sharding.ClusterOptions{
+				CircuitBreaker: opt,
+			})
+			Expect(opt.Backoff).To(BeNil())
+
+			Expect(cl.ForEachShard(func(shard *pg.DB) error {
+				return connErr
+			})).To(MatchError(connErr))
+			Expect(cl.OpenCircuits()).To(Equal([]*pg.DB{db1}))
+
+			time.Sleep(30 * time.Millisecond)
+			Expect(cl.ForEachShard(func(shard *pg.DB) error {
+				return errors.New("fake error")
+			})).To(MatchError("fake error"))
+			Expect(cl.OpenCircuits()).To(BeEmpty())
+			Expect(cl.ForEachShard(func(shard *pg.DB) error {
 				return nil
+			})).NotTo(HaveOccurred())
+		})
+
+		It("does not count application errors", func() {
+			for i := 0; i < 3; i++ {
+				err := cluster.ForEachShard(func(shard *pg.DB) error {
+					return errors.New("fake error")
+				})
+				Expect(err).To(MatchError("fake error"))
+			}
+			Expect(cluster.OpenCircuits()).To(BeEmpty())
+		})
+	})
+
+	Describe("RateLimits", func() {
+		It("limits rate of queries per server", func() {
+			stub1, stub2 := sharding.NewStubDB("stub1"), sharding.NewStubDB("stub2")
+			cl := sharding.NewClusterWithOptions([]*pg.DB{stub1, stub2}, 4, &sharding.ClusterOptions{
+				RateLimits: map[*pg.DB]*sharding.RateLimit{
+					stub1: {Rate: 20},
+				},
 			})
-			Expect(err).To(MatchError("fake error"))
+			defer cl.Close()
+
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				_, err := cl.Shard(0).Exec(`SELECT 1`)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(time.Since(start)).To(BeNumerically(">=", 90*time.Millisecond))
+
+			start = time.Now()
+			for i := 0; i < 3; i++ {
+				_, err := cl.Shard(1).Exec(`SELECT 1`)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(time.Since(start)).To(BeNumerically("<", 40*time.Millisecond))
+		})
+
+		It("fails fast without closing connection", func() {
+			stub := sharding.NewStubDB("stub")
+			cl := sharding.NewClusterWithOptions([]*pg.DB{stub}, 2, &sharding.ClusterOptions{
+				RateLimits: map[*pg.DB]*sharding.RateLimit{
+					stub: {Rate: 1, FailFast: true},
+				},
+			})
+			defer cl.Close()
+
+			shard := cl.Shard(1)
+			_, err := shard.Exec(`SELECT 1`)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = cl.Shard(0).Exec(`SELECT 1`)
+			Expect(err).To(Equal(sharding.ErrRateLimited))
+			Expect(shard.PoolStats().TotalConns).To(Equal(uint32(1)))
+		})
+
+		It("shares pool and limit of dbs connected to the same server", func() {
+			stub1, stub2 := sharding.NewStubDB("stub"), sharding.NewStubDB("stub")
+			cl := sharding.NewClusterWithOptions([]*pg.DB{stub1, stub2}, 2, &sharding.ClusterOptions{
+				RateLimits: map[*pg.DB]*sharding.RateLimit{
+					stub1: {Rate: 1, FailFast: true},
+				},
+			})
+			defer cl.Close()
+
+			_, err := cl.Shard(0).Exec(`SELECT 1`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cl.Shard(1).PoolStats().TotalConns).To(Equal(uint32(1)))
+			_, err = cl.Shard(1).Exec(`SELECT 1`)
+			Expect(err).To(Equal(sharding.ErrRateLimited))
+		})
+
+		It("panics on non-positive rate", func() {
+			Expect(recovered(func() {
+				sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+					RateLimits: map[*pg.DB]*sharding.RateLimit{
+						db2: {},
+					},
+				})
+			})).To(Equal("sharding: rate limit of tcp://@db2/ must be positive, got 0"))
+			Expect(recovered(func() {
+				sharding.WithRateLimit(sharding.RateLimit{Rate: -1})
+			})).To(Equal("sharding: WithRateLimit rate must be positive, got -1"))
+		})
+
+		It("fails fast", func() {
+			cl := sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+				RateLimits: map[*pg.DB]*sharding.RateLimit{
+					db1: {Rate: 1, FailFast: true},
+				},
+			})
+
+			ctx := context.Background()
+			Expect(cl.WaitRateLimit(ctx, cl.Shard(0))).NotTo(HaveOccurred())
+			Expect(cl.WaitRateLimit(ctx, cl.Shard(2))).To(Equal(sharding.ErrRateLimited))
+			Expect(cl.WaitRateLimit(ctx, cl.Shard(1))).NotTo(HaveOccurred())
+		})
+
+		It("respects context while waiting", func() {
+			cl := sharding.NewClusterWithOptions([]*pg.DB{db1}, 1, &sharding.ClusterOptions{
+				RateLimits: map[*pg.DB]*sharding.RateLimit{
+					db1: {Rate: 0.1},
+				},
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			Expect(cl.WaitRateLimit(ctx, cl.Shard(0))).NotTo(HaveOccurred())
+			Expect(cl.WaitRateLimit(ctx, cl.Shard(0))).To(Equal(context.DeadlineExceeded))
 		})
 	})
 
-	Describe("ForEachNShards", func() {
-		It("fn is called once for every shard", func() {
-			var shards []int64
-			var mu sync.Mutex
-			err := cluster.ForEachNShards(2, func(shard *pg.DB) error {
-				defer GinkgoRecover()
+	It("processes heavier shards first", func() {
+		cl := sharding.NewCluster([]*pg.DB{db1, db2}, 8)
+		weights := []int{1, 5, 3, 5, 2, 0, 9, 1}
 
-				shardId := shardId(shard)
-				mu.Lock()
-				Expect(shards).NotTo(ContainElement(shardId))
-				shards = append(shards, shardId)
-				mu.Unlock()
-				return nil
+		var mu sync.Mutex
+		order := make(map[string][]int64)
+		err := cl.ForEachShardWeighted(func(shardId int64) int {
+			return weights[shardId]
+		}, func(shard *pg.DB) error {
+			mu.Lock()
+			addr := shard.Options().Addr
+			order[addr] = append(order[addr], shardId(shard))
+			mu.Unlock()
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(order).To(Equal(map[string][]int64{
+			"db1": {6, 2, 4, 0},
+			"db2": {1, 3, 7, 5},
+		}))
+	})
+
+	Describe("ForEachShardUntil", func() {
+		It("stops when shard is found", func() {
+			cl := sharding.NewCluster([]*pg.DB{db1}, 8)
+			var calls int32
+			shard, err := cl.ForEachShardUntil(func(shard *pg.DB) (bool, error) {
+				atomic.AddInt32(&calls, 1)
+				return shardId(shard) == 2, nil
 			})
 			Expect(err).NotTo(HaveOccurred())
-			Expect(shards).To(HaveLen(4))
-			for shardId := int64(0); shardId < 4; shardId++ {
-				Expect(shards).To(ContainElement(shardId))
+			Expect(shardId(shard)).To(Equal(int64(2)))
+			Expect(calls).To(Equal(int32(3)))
+		})
+
+		It("returns nil shard when nothing is found", func() {
+			shard, err := cluster.ForEachShardUntil(func(shard *pg.DB) (bool, error) {
+				return false, nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shard).To(BeNil())
+		})
+	})
+
+	Describe("ForEachShardResult", func() {
+		It("returns outcome of every shard", func() {
+			outcomes := cluster.ForEachShardResult(func(shard *pg.DB) error {
+				if shardId(shard)%2 == 1 {
+					return fmt.Errorf("shard%d failed", shardId(shard))
+				}
+				return nil
+			}, sharding.WithStopOnError())
+			Expect(outcomes).To(HaveLen(4))
+			for i, outcome := range outcomes {
+				Expect(outcome.ShardId).To(Equal(int64(i)))
+				if i%2 == 1 {
+					Expect(outcome.Err).To(MatchError(fmt.Sprintf("shard%d failed", i)))
+				} else {
+					Expect(outcome.Err).NotTo(HaveOccurred())
+				}
 			}
 		})
 
-		It("returns an error if fn fails", func() {
-			err := cluster.ForEachNShards(2, func(shard *pg.DB) error {
-				if shardId(shard) == 3 {
-					return errors.New("fake error")
+		It("reports shards skipped by circuit breaker", func() {
+			cl := sharding.NewClusterWithOptions([]*pg.DB{db1, db2}, 4, &sharding.ClusterOptions{
+				CircuitBreaker: &sharding.CircuitBreakerOptions{
+					MaxFailures: 1,
+				},
+			})
+			cl.ForEachShardResult(func(shard *pg.DB) error {
+				if shard.Options().Addr == "db2" {
+					return io.ErrUnexpectedEOF
 				}
 				return nil
 			})
-			Expect(err).To(MatchError("fake error"))
+
+			outcomes := cl.ForEachShardResult(func(shard *pg.DB) error {
+				return nil
+			})
+			Expect(outcomes).To(HaveLen(4))
+			Expect(outcomes[0].Err).NotTo(HaveOccurred())
+			Expect(outcomes[1].Err).To(Equal(sharding.ErrCircuitOpen))
+			Expect(outcomes[3].Err).To(Equal(sharding.ErrCircuitOpen))
+		})
+	})
+
+	Describe("ForEachShardWithLimit", func() {
+		It("returns partial results on deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			results, unfinished, err := sharding.ForEachShardWithLimit(
+				ctx, cluster, func(ctx context.Context, shard *pg.DB) (int64, error) {
+					id := shardId(shard)
+					if id == 3 {
+						<-ctx.Done()
+						return 0, ctx.Err()
+					}
+					return id * 10, nil
+				})
+			Expect(err).To(Equal(context.DeadlineExceeded))
+			Expect(results).To(Equal(map[int64]int64{0: 0, 1: 10, 2: 20}))
+			Expect(unfinished).To(Equal([]int64{3}))
+		})
+
+		It("returns all results", func() {
+			results, unfinished, err := sharding.ForEachShardWithLimit(
+				context.Background(), cluster, func(ctx context.Context, shard *pg.DB) (int64, error) {
+					return shardId(shard), nil
+				})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(HaveLen(4))
+			Expect(unfinished).To(BeEmpty())
 		})
 	})
 
@@ -271,6 +3337,9 @@ var _ = Describe("Cluster", func() {
 
 				{cluster.SubCluster(0, 16), []int64{0, 1, 2, 3, 4, 5, 6, 7}},
 				{cluster.SubCluster(1, 16), []int64{0, 1, 2, 3, 4, 5, 6, 7}},
+
+				{cluster.SubCluster(3, 0), []int64{3}},
+				{cluster.SubCluster(3, -1), []int64{3}},
 			}
 			for _, test := range tests {
 				var mu sync.Mutex
@@ -288,7 +3357,7 @@ var _ = Describe("Cluster", func() {
 					return shardIds[i] < shardIds[j]
 				})
 				Expect(shardIds).To(Equal(test.shardIds))
-				Expect(len(dbs)).To(Equal(min(len(alldbs), len(shardIds))))
+				Expect(len(dbs)).To(Equal(minInt(len(alldbs), len(shardIds))))
 
 				shardIds = shardIds[:0]
 				add := func(shardId int64) {
@@ -313,12 +3382,28 @@ var _ = Describe("Cluster", func() {
 })
 
 func shardId(shard *pg.DB) int64 {
-	return shard.Param("shard_id").(int64)
+	return sharding.ShardId(shard)
+}
+
+func recovered(fn func()) (v interface{}) {
+	defer func() {
+		v = recover()
+	}()
+	fn()
+	return nil
 }
 
-func min(a, b int) int {
+func minInt(a, b int) int {
 	if a <= b {
 		return a
 	}
 	return b
 }
+
+func dropShardSchemas(cluster *sharding.Cluster) {
+	err := cluster.ForEachShard(func(shard *pg.DB) error {
+		_, err := shard.Exec(`DROP SCHEMA IF EXISTS ?shard CASCADE`)
+		return err
+	})
+	Expect(err).NotTo(HaveOccurred())
+}
@@ -0,0 +1,144 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// ClusterConfig describes cluster layout: servers, shards and their
+// placement. It can be serialized with encoding/json and used to
+// reconstruct the cluster with NewClusterFromConfig.
+type ClusterConfig struct {
+	Servers []ServerConfig `json:"servers"`
+	// DBs lists indexes of Servers in the order dbs were passed to the
+	// cluster constructor.
+	DBs []int `json:"dbs"`
+	// Shards maps shard id to the index of the server in Servers.
+	Shards []int `json:"shards"`
+	// ConsistentHashing is set when shards are placed using
+	// ClusterOptions.ConsistentHashing.
+	ConsistentHashing bool        `json:"consistent_hashing,omitempty"`
+	IdGen             IdGenConfig `json:"idgen"`
+}
+
+// ServerConfig identifies PostgreSQL server and database. It does not
+// contain credentials.
+type ServerConfig struct {
+	Network  string `json:"network"`
+	Addr     string `json:"addr"`
+	User     string `json:"user"`
+	Database string `json:"database"`
+}
+
+// IdGenConfig describes IdGen layout.
+type IdGenConfig struct {
+	TimeBits  uint      `json:"time_bits"`
+	ShardBits uint      `json:"shard_bits"`
+	SeqBits   uint      `json:"seq_bits"`
+	Epoch     time.Time `json:"epoch"`
+}
+
+// Config returns cluster layout.
+func (cl *Cluster) Config() *ClusterConfig {
+	cfg := &ClusterConfig{
+		DBs:    make([]int, len(cl.dbs)),
+		Shards: make([]int, len(cl.shards)),
+
+		ConsistentHashing: cl.opt.ConsistentHashing,
+		IdGen: IdGenConfig{
+			TimeBits:  64 - cl.gen.shardBits - cl.gen.seqBits,
+			ShardBits: cl.gen.shardBits,
+			SeqBits:   cl.gen.seqBits,
+			Epoch:     time.Unix(0, cl.gen.epoch*int64(time.Millisecond)).UTC(),
+		},
+	}
+
+	serverIndex := make(map[*pg.DB]int, len(cl.servers))
+	for i, db := range cl.servers {
+		serverIndex[db] = i
+		opt := db.Options()
+		cfg.Servers = append(cfg.Servers, ServerConfig{
+			Network:  opt.Network,
+			Addr:     opt.Addr,
+			User:     opt.User,
+			Database: opt.Database,
+		})
+	}
+	for i, db := range cl.dbs {
+		cfg.DBs[i] = serverIndex[cl.server(db)]
+	}
+	for i, db := range cl.shardServers {
+		cfg.Shards[i] = serverIndex[db]
+	}
+	return cfg
+}
+
+// NewClusterFromConfig reconstructs the cluster described by the cfg.
+// The newDB is called once for every server to connect to it.
+func NewClusterFromConfig(
+	cfg *ClusterConfig, newDB func(server ServerConfig) *pg.DB,
+) (*Cluster, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("sharding: config has no servers")
+	}
+	if len(cfg.Shards) == 0 || len(cfg.DBs) == 0 {
+		return nil, errors.New("sharding: config has no shards")
+	}
+	for _, ind := range cfg.DBs {
+		if ind < 0 || ind >= len(cfg.Servers) {
+			return nil, fmt.Errorf("sharding: config has invalid server index %d", ind)
+		}
+	}
+	if len(cfg.Shards)%len(cfg.DBs) != 0 {
+		return nil, errors.New(
+			"sharding: number of shards must be divisible by number of dbs")
+	}
+	for i, ind := range cfg.Shards {
+		if ind < 0 || ind >= len(cfg.Servers) {
+			return nil, fmt.Errorf("sharding: config has invalid server index %d", ind)
+		}
+		if !cfg.ConsistentHashing && ind != cfg.DBs[i%len(cfg.DBs)] {
+			return nil, fmt.Errorf(
+				"sharding: shard %d is placed on server %d, expected %d",
+				i, ind, cfg.DBs[i%len(cfg.DBs)])
+		}
+	}
+
+	idg := cfg.IdGen
+	if idg.TimeBits+idg.ShardBits+idg.SeqBits != 64 {
+		return nil, errors.New("sharding: config has invalid IdGen layout")
+	}
+	gen := NewIdGen(idg.TimeBits, idg.ShardBits, idg.SeqBits, idg.Epoch)
+	if len(cfg.Shards) > gen.NumShards() {
+		return nil, fmt.Errorf(
+			"sharding: nshards=%d exceeds IdGen capacity %d", len(cfg.Shards), gen.NumShards())
+	}
+
+	servers := make([]*pg.DB, len(cfg.Servers))
+	for i, server := range cfg.Servers {
+		servers[i] = newDB(server)
+	}
+	dbs := make([]*pg.DB, len(cfg.DBs))
+	for i, ind := range cfg.DBs {
+		dbs[i] = servers[ind]
+	}
+
+	cl := NewClusterWithOptions(dbs, len(cfg.Shards), &ClusterOptions{
+		IdGen:             gen,
+		ConsistentHashing: cfg.ConsistentHashing,
+	})
+	if cfg.ConsistentHashing {
+		for i, ind := range cfg.Shards {
+			if cl.shardServers[i] != cl.server(servers[ind]) {
+				_ = cl.Close()
+				return nil, fmt.Errorf(
+					"sharding: shard %d is placed on server %d, expected %s",
+					i, ind, serverKey(cl.shardServers[i]))
+			}
+		}
+	}
+	return cl, nil
+}
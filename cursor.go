@@ -0,0 +1,162 @@
+package sharding
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/go-pg/pg"
+)
+
+var errInvalidCursor = errors.New("sharding: invalid cursor")
+
+// CrossShardCursor paginates rows ordered by an int64 key (e.g. id
+// generated by IdGen) across all shards in the cluster without
+// LIMIT/OFFSET. The query is executed on every shard with ?after and
+// ?limit params set, for example:
+//
+//	SELECT * FROM ?shard.users WHERE id > ?after ORDER BY id LIMIT ?limit
+//
+// Keys must be unique within a shard and rows must be returned in
+// ascending key order. Cursor remembers the last key returned from each
+// shard and can be serialized with Encode to resume pagination later,
+// e.g. in another HTTP request. Shards on servers disabled with
+// DisableServer are included like in other read helpers.
+type CrossShardCursor[T any] struct {
+	cl       *Cluster
+	query    string
+	pageSize int
+	key      func(row T) int64
+
+	lastKeys map[int64]int64
+}
+
+// NewCrossShardCursor returns cursor that starts at the beginning of the
+// rows.
+func NewCrossShardCursor[T any](
+	cl *Cluster, query string, pageSize int, key func(row T) int64,
+) *CrossShardCursor[T] {
+	return &CrossShardCursor[T]{
+		cl:       cl,
+		query:    query,
+		pageSize: pageSize,
+		key:      key,
+		lastKeys: make(map[int64]int64),
+	}
+}
+
+type cursorRow[T any] struct {
+	shardId int64
+	key     int64
+	row     T
+}
+
+// Next fetches pageSize rows from each shard, merges them and returns
+// the next page. It returns empty page when there are no more rows.
+func (c *CrossShardCursor[T]) Next() ([]T, error) {
+	var mu sync.Mutex
+	var perShard [][]cursorRow[T]
+	err := c.cl.ForEachShard(func(shard *pg.DB) error {
+		id := ShardId(shard)
+		after, ok := c.lastKeys[id]
+		if !ok {
+			after = math.MinInt64
+		}
+
+		var rows []T
+		_, err := shard.WithParam("after", after).
+			WithParam("limit", c.pageSize).
+			Query(&rows, c.query)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+
+		crows := make([]cursorRow[T], len(rows))
+		for i, row := range rows {
+			crows[i] = cursorRow[T]{
+				shardId: id,
+				key:     c.key(row),
+				row:     row,
+			}
+		}
+
+		mu.Lock()
+		perShard = append(perShard, crows)
+		mu.Unlock()
+		return nil
+	}, WithDisabled())
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(perShard, func(i, j int) bool {
+		return perShard[i][0].shardId < perShard[j][0].shardId
+	})
+	merged := MergeSortedShards(perShard, func(a, b cursorRow[T]) bool {
+		return a.key < b.key
+	})
+	if len(merged) > c.pageSize {
+		merged = merged[:c.pageSize]
+	}
+
+	page := make([]T, len(merged))
+	for i, crow := range merged {
+		page[i] = crow.row
+		c.lastKeys[crow.shardId] = crow.key
+	}
+	return page, nil
+}
+
+// Encode returns URL-safe string that contains last key returned from
+// each shard.
+func (c *CrossShardCursor[T]) Encode() string {
+	ids := make([]int64, 0, len(c.lastKeys))
+	for id := range c.lastKeys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	b := make([]byte, len(ids)*2*binary.MaxVarintLen64)
+	var n int
+	for _, id := range ids {
+		n += binary.PutVarint(b[n:], id)
+		n += binary.PutVarint(b[n:], c.lastKeys[id])
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:n])
+}
+
+// Decode restores cursor position from the string returned by Encode.
+func (c *CrossShardCursor[T]) Decode(s string) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return errInvalidCursor
+	}
+
+	lastKeys := make(map[int64]int64)
+	for len(b) > 0 {
+		id, n := binary.Varint(b)
+		if n <= 0 {
+			return errInvalidCursor
+		}
+		b = b[n:]
+
+		key, n := binary.Varint(b)
+		if n <= 0 {
+			return errInvalidCursor
+		}
+		b = b[n:]
+
+		lastKeys[id] = key
+	}
+
+	c.lastKeys = lastKeys
+	return nil
+}
@@ -0,0 +1,60 @@
+package sharding
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+type debouncedSweep struct {
+	done chan struct{}
+	err  error
+}
+
+// ForEachShardDebounced returns a function that coalesces calls into
+// ForEachShard with the fn and opts, e.g. to refresh a cluster-wide cache
+// once when many events arrive at the same time. The first call starts
+// a window; the sweep starts when the window elapses and every call made
+// during the window waits for it and returns its error. Calls made while
+// the sweep is running start the next window.
+//
+// The returned function returns ctx.Err() if the ctx is done before the
+// sweep finishes; the sweep itself is not interrupted.
+func (cl *Cluster) ForEachShardDebounced(
+	window time.Duration, fn func(shard *pg.DB) error, opts ...ForEachOption,
+) func(ctx context.Context) error {
+	if fn == nil {
+		panic("sharding: ForEachShardDebounced is called with nil fn")
+	}
+
+	var mu sync.Mutex
+	var pending *debouncedSweep
+	return func(ctx context.Context) error {
+		mu.Lock()
+		sweep := pending
+		if sweep == nil {
+			sweep = &debouncedSweep{
+				done: make(chan struct{}),
+			}
+			pending = sweep
+			time.AfterFunc(window, func() {
+				mu.Lock()
+				pending = nil
+				mu.Unlock()
+
+				sweep.err = cl.ForEachShard(fn, opts...)
+				close(sweep.done)
+			})
+		}
+		mu.Unlock()
+
+		select {
+		case <-sweep.done:
+			return sweep.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
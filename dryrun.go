@@ -0,0 +1,171 @@
+package sharding
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-pg/pg"
+)
+
+// DryRun calls the fn on every shard and returns statements executed by
+// the fn keyed by shard id without sending them to the servers.
+// Statements are formatted with shard params and args, so they can be
+// reviewed or diffed across shards before the real run.
+//
+// The fn is passed a shard that is connected to a stub server: every
+// statement is recorded and succeeds with a zero result that has no
+// rows, so QueryOne, ExecOne and Select return pg.ErrNoRows. COPY and
+// prepared statements are not supported and return an error.
+func (cl *Cluster) DryRun(
+	fn func(shard *pg.DB) error, opts ...ForEachOption,
+) (map[int64][]string, error) {
+	if fn == nil {
+		panic("sharding: DryRun is called with nil fn")
+	}
+
+	var mu sync.Mutex
+	stmts := make(map[int64][]string, len(cl.shards))
+	err := cl.ForEachShard(func(shard *pg.DB) error {
+		q, err := cl.dryRun(shard, fn)
+		mu.Lock()
+		stmts[ShardId(shard)] = q
+		mu.Unlock()
+		return err
+	}, opts...)
+	return stmts, err
+}
+
+func (cl *Cluster) dryRun(shard *pg.DB, fn func(shard *pg.DB) error) ([]string, error) {
+	rec := new(dryRunRecorder)
+	db := pg.Connect(&pg.Options{
+		User:     shard.Options().User,
+		Database: shard.Options().Database,
+		PoolSize: 1,
+		Dialer: func(network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go rec.serve(server)
+			return client, nil
+		},
+	})
+	defer db.Close()
+
+	dry := cl.withShardParams(db, ShardId(shard)).WithContext(shard.Context())
+	err := fn(dry)
+	return rec.statements(), err
+}
+
+// dryRunRecorder implements just enough of PostgreSQL wire protocol to
+// accept connections and record simple queries.
+type dryRunRecorder struct {
+	mu    sync.Mutex
+	stmts []string
+}
+
+func (r *dryRunRecorder) statements() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stmts
+}
+
+func (r *dryRunRecorder) serve(cn net.Conn) {
+	defer cn.Close()
+	rd := bufio.NewReader(cn)
+
+	// Startup message has no type byte.
+	if _, err := readDryRunMessage(rd); err != nil {
+		return
+	}
+	if _, err := cn.Write(dryRunAuthOK); err != nil {
+		return
+	}
+
+	var failExtended bool
+	for {
+		c, err := rd.ReadByte()
+		if err != nil {
+			return
+		}
+		b, err := readDryRunMessage(rd)
+		if err != nil {
+			return
+		}
+
+		var resp []byte
+		switch c {
+		case 'Q':
+			query := string(bytes.TrimRight(b, "\x00"))
+			r.mu.Lock()
+			r.stmts = append(r.stmts, query)
+			r.mu.Unlock()
+
+			if isCopyQuery(query) {
+				resp = append(dryRunError("COPY is not supported in dry run"), dryRunReadyForQuery...)
+			} else {
+				resp = dryRunCommandComplete
+			}
+		case 'P', 'B', 'D', 'E', 'C', 'H':
+			failExtended = true
+			continue
+		case 'S':
+			resp = dryRunReadyForQuery
+			if failExtended {
+				failExtended = false
+				resp = append(dryRunError("prepared statements are not supported in dry run"), resp...)
+			}
+		case 'X':
+			return
+		default:
+			continue
+		}
+		if _, err := cn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func readDryRunMessage(rd *bufio.Reader) ([]byte, error) {
+	var n int32
+	if err := binary.Read(rd, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n-4)
+	_, err := io.ReadFull(rd, b)
+	return b, err
+}
+
+func isCopyQuery(query string) bool {
+	query = strings.TrimSpace(query)
+	return len(query) >= 4 && strings.EqualFold(query[:4], "COPY")
+}
+
+var (
+	dryRunAuthOK = []byte{
+		'R', 0, 0, 0, 8, 0, 0, 0, 0,
+		'Z', 0, 0, 0, 5, 'I',
+	}
+	dryRunCommandComplete = []byte{
+		'C', 0, 0, 0, 13, 'S', 'E', 'L', 'E', 'C', 'T', ' ', '0', 0,
+		'Z', 0, 0, 0, 5, 'I',
+	}
+	dryRunReadyForQuery = []byte{'Z', 0, 0, 0, 5, 'I'}
+)
+
+func dryRunError(msg string) []byte {
+	var body []byte
+	body = append(body, 'S')
+	body = append(body, "ERROR\x00"...)
+	body = append(body, 'C')
+	body = append(body, "0A000\x00"...)
+	body = append(body, 'M')
+	body = append(body, "sharding: "+msg+"\x00"...)
+	body = append(body, 0)
+
+	b := []byte{'E', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(len(body)+4))
+	return append(b, body...)
+}
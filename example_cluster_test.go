@@ -2,6 +2,7 @@ package sharding_test
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/go-pg/sharding"
 
@@ -127,6 +128,30 @@ func ExampleCluster() {
 	// user1 user2
 }
 
+func ExampleShardAccumulator() {
+	db := pg.Connect(&pg.Options{
+		User: "postgres",
+	})
+	cluster := sharding.NewCluster([]*pg.DB{db}, 4)
+	defer cluster.Close()
+
+	// Callbacks run concurrently, so gather their output
+	// with the accumulator rather than appending to a slice.
+	var names sharding.ShardAccumulator[string]
+	err := cluster.ForEachShard(func(shard *pg.DB) error {
+		names.Add(sharding.QuotedShardName(shard))
+		return nil
+	}, sharding.WithConcurrency(4))
+	if err != nil {
+		panic(err)
+	}
+
+	results := names.Results()
+	sort.Strings(results)
+	fmt.Println(results)
+	// Output: ["shard0" "shard1" "shard2" "shard3"]
+}
+
 const sqlFuncs = `
 CREATE SEQUENCE ?shard.id_seq;
 
@@ -1,7 +1,32 @@
 package sharding
 
-import "math/rand"
+import (
+	"math/rand"
+	"net"
+
+	"github.com/go-pg/pg"
+)
 
 func SetRandSeed(r *rand.Rand) {
 	randSeed = r
 }
+
+var QuoteIdent = quoteIdent
+
+var WriteCopyRows = writeCopyRows
+
+// StubDialer connects to a stub server that accepts every simple query
+// and returns no rows.
+func StubDialer(network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go new(dryRunRecorder).serve(server)
+	return client, nil
+}
+
+// NewStubDB returns db connected with StubDialer.
+func NewStubDB(addr string) *pg.DB {
+	return pg.Connect(&pg.Options{
+		Addr:   addr,
+		Dialer: StubDialer,
+	})
+}
@@ -0,0 +1,454 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// ForEachOption configures ForEach* methods.
+type ForEachOption func(*forEachOptions)
+
+type forEachOptions struct {
+	includeDisabled bool
+	concurrency     int
+	ctx             context.Context
+	stopOnError     bool
+	continueOnError bool
+	maxRetries      int
+	retryBackoff    Backoff
+	reconnect       *reconnectOptions
+	progress        func(completed, total int)
+	semaphore       chan struct{}
+	rateLimit       *tokenBucket
+	userObserver    shardObserver
+
+	// observers are called after each shard is processed,
+	// e.g. by ForEachShardResult.
+	observers []shardObserver
+}
+
+type shardObserver func(shardId int64, dur time.Duration, err error)
+
+func newForEachOptions(opts []ForEachOption) *forEachOptions {
+	opt := &forEachOptions{
+		concurrency: 1,
+		ctx:         context.Background(),
+	}
+	for _, fn := range opts {
+		fn(opt)
+	}
+	return opt
+}
+
+// WithDisabled makes ForEach* methods include servers disabled
+// with DisableServer.
+func WithDisabled() ForEachOption {
+	return func(opt *forEachOptions) {
+		opt.includeDisabled = true
+	}
+}
+
+// WithConcurrency sets max number of shards that are processed
+// concurrently on each server. Default is 1.
+func WithConcurrency(n int) ForEachOption {
+	return func(opt *forEachOptions) {
+		if n < 1 {
+			n = 1
+		}
+		opt.concurrency = n
+	}
+}
+
+// WithContext stops processing of remaining shards when the ctx is done.
+// Shards that are already being processed are not interrupted unless fn
+// respects the ctx itself.
+func WithContext(ctx context.Context) ForEachOption {
+	return func(opt *forEachOptions) {
+		opt.ctx = ctx
+	}
+}
+
+// WithStopOnError stops processing of remaining shards after fn returns
+// the first error. By default fn is called on every shard and the first
+// error is returned.
+func WithStopOnError() ForEachOption {
+	return func(opt *forEachOptions) {
+		opt.stopOnError = true
+	}
+}
+
+// WithContinueOnError makes ForEach* methods call fn on every shard
+// regardless of errors and return *ShardsError that contains errors of
+// all failed shards instead of the first error. It overrides
+// WithStopOnError.
+func WithContinueOnError() ForEachOption {
+	return func(opt *forEachOptions) {
+		opt.continueOnError = true
+	}
+}
+
+// WithSemaphore makes ForEach* methods acquire the sem, i.e. send to it,
+// before calling fn on a shard and release it after fn returns, so
+// independent ForEach* calls that share the sem never call fn on more
+// shards than its capacity at the same time, e.g. to bound total number
+// of queries in the process. Per-server concurrency set with
+// WithConcurrency still applies.
+func WithSemaphore(sem chan struct{}) ForEachOption {
+	return func(opt *forEachOptions) {
+		opt.semaphore = sem
+	}
+}
+
+// WithRateLimit limits how fast ForEach* methods start calling fn on
+// shards across all servers, e.g. to pace a backfill so replicas keep up.
+// Unlike ClusterOptions.RateLimits, which apply to each server, the limit
+// applies to the whole ForEach* call regardless of number of servers.
+// Waiting for the limit stops when the context set with WithContext or
+// the cluster context is done.
+func WithRateLimit(limit RateLimit) ForEachOption {
+	if !(limit.Rate > 0) {
+		panic(fmt.Sprintf("sharding: WithRateLimit rate must be positive, got %v", limit.Rate))
+	}
+	return func(opt *forEachOptions) {
+		opt.rateLimit = newTokenBucket(&limit)
+	}
+}
+
+// WithObserver calls the fn after each shard is processed with the shard
+// id, time the shard spent in fn including retries and the error. Time
+// spent waiting for WithSemaphore and rate limits is not included, so
+// durations of concurrently processed shards are comparable, e.g. to
+// find a slow shard. The fn is called concurrently.
+func WithObserver(fn func(shardId int64, dur time.Duration, err error)) ForEachOption {
+	return func(opt *forEachOptions) {
+		opt.userObserver = fn
+	}
+}
+
+// WithProgress calls the fn after each shard is processed, successfully
+// or not, with number of processed shards and total number of shards to
+// process, e.g. to show a progress bar. Calls are serialized.
+func WithProgress(fn func(completed, total int)) ForEachOption {
+	return func(opt *forEachOptions) {
+		opt.progress = fn
+	}
+}
+
+// WithRetry retries fn up to maxRetries times when it returns an error
+// waiting backoff between attempts.
+func WithRetry(maxRetries int, backoff time.Duration) ForEachOption {
+	return WithRetryBackoff(maxRetries, ConstantBackoff(backoff))
+}
+
+// WithRetryBackoff is like WithRetry, but waits delay returned by
+// the backoff before each retry. Nil backoff retries without waiting.
+func WithRetryBackoff(maxRetries int, backoff Backoff) ForEachOption {
+	if backoff == nil {
+		backoff = ConstantBackoff(0)
+	}
+	return func(opt *forEachOptions) {
+		opt.maxRetries = maxRetries
+		opt.retryBackoff = backoff
+	}
+}
+
+func (opt *forEachOptions) call(
+	ctx context.Context, fn func(shard *pg.DB) error, server, shard *pg.DB,
+) error {
+	var err error
+	for attempt := 0; attempt <= opt.maxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, opt.retryBackoff.NextDelay(attempt)); err != nil {
+				return err
+			}
+		}
+
+		err = wrapPoolTimeout(fn(shard))
+		if err != nil && opt.reconnect != nil {
+			err = opt.reconnect.retry(ctx, fn, server, shard, err)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (cl *Cluster) forEachDB(fn func(db *pg.DB) error, opt *forEachOptions) error {
+	servers := cl.servers
+	if !opt.includeDisabled {
+		servers = cl.enabledServers()
+	}
+
+	errCh := make(chan error, 1)
+	var wg sync.WaitGroup
+	for _, db := range servers {
+		if cl.ctxErr(opt) != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(db *pg.DB) {
+			defer wg.Done()
+			if err := fn(db); err != nil {
+				select {
+				case errCh <- err:
+				default:
+				}
+			}
+		}(db)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return cl.ctxErr(opt)
+	}
+}
+
+// ctxErr returns error of the ForEach context or of the cluster context.
+func (cl *Cluster) ctxErr(opt *forEachOptions) error {
+	if err := opt.ctx.Err(); err != nil {
+		return err
+	}
+	if cl.ctx != nil {
+		return cl.ctx.Err()
+	}
+	return nil
+}
+
+func (cl *Cluster) forEachShard(
+	shards, shardServers []*pg.DB, fn func(shard *pg.DB) error, opt *forEachOptions,
+) (err error) {
+	if cl.opt.Tracer != nil {
+		// Spans are children of the cluster context rather than
+		// of opt.ctx, because shards passed to fn are bound to them.
+		spanCtx := cl.ctx
+		if spanCtx == nil {
+			spanCtx = context.Background()
+		}
+		spanCtx, span := cl.opt.Tracer.Start(spanCtx, "sharding.ForEachShard", time.Now(), nil)
+		defer func() {
+			span.End(err)
+		}()
+		fn = cl.traceForEachShard(spanCtx, fn)
+	}
+
+	// Observers are collected locally, so opt is not modified
+	// and can be reused.
+	observers := append([]shardObserver(nil), opt.observers...)
+	if opt.userObserver != nil {
+		observers = append(observers, opt.userObserver)
+	}
+
+	if opt.progress != nil {
+		servers := cl.servers
+		if !opt.includeDisabled {
+			servers = cl.enabledServers()
+		}
+		var total int
+		for _, server := range shardServers {
+			for _, db := range servers {
+				if db == server {
+					total++
+					break
+				}
+			}
+		}
+
+		var mu sync.Mutex
+		var completed int
+		observers = append(observers, func(shardId int64, dur time.Duration, err error) {
+			mu.Lock()
+			completed++
+			opt.progress(completed, total)
+			mu.Unlock()
+		})
+	}
+
+	stopOnError := opt.stopOnError
+	if opt.continueOnError {
+		stopOnError = false
+		errs := new(ShardsError)
+		observers = append(observers, func(shardId int64, dur time.Duration, err error) {
+			if err != nil {
+				errs.add(shardId, err)
+			}
+		})
+		defer func() {
+			if len(errs.Errors) > 0 {
+				errs.sort()
+				err = errs
+			}
+		}()
+	}
+
+	observe := func(shardId int64, dur time.Duration, err error) {
+		for _, fn := range observers {
+			fn(shardId, dur, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(opt.ctx)
+	defer cancel()
+	if cl.ctx != nil {
+		go func() {
+			select {
+			case <-cl.ctx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	return cl.forEachDB(func(db *pg.DB) error {
+		if cl.isUnreachable(db) {
+			for i, shard := range shards {
+				if shardServers[i] == db {
+					observe(ShardId(shard), 0, ErrServerUnreachable)
+				}
+			}
+			return ErrServerUnreachable
+		}
+
+		var wg sync.WaitGroup
+		errCh := make(chan error, 1)
+		limit := make(chan struct{}, opt.concurrency)
+
+	loop:
+		for i, shard := range shards {
+			if shardServers[i] != db {
+				continue
+			}
+
+			select {
+			case limit <- struct{}{}:
+			case <-ctx.Done():
+				break loop
+			}
+			if ctx.Err() != nil {
+				break
+			}
+
+			wg.Add(1)
+			go func(shard *pg.DB) {
+				defer func() {
+					<-limit
+					wg.Done()
+				}()
+				var err error
+				if opt.rateLimit != nil {
+					err = opt.rateLimit.wait(ctx)
+				}
+				if opt.semaphore != nil && err == nil {
+					select {
+					case opt.semaphore <- struct{}{}:
+						defer func() {
+							<-opt.semaphore
+						}()
+					case <-ctx.Done():
+						err = ctx.Err()
+					}
+				}
+				start := time.Now()
+				if err == nil {
+					err = cl.withBreaker(db, func() error {
+						return opt.call(ctx, fn, db, shard)
+					})
+				}
+				observe(ShardId(shard), time.Since(start), err)
+				if err != nil {
+					if stopOnError {
+						cancel()
+					}
+					select {
+					case errCh <- err:
+					default:
+					}
+				}
+			}(shard)
+		}
+
+		wg.Wait()
+
+		select {
+		case err := <-errCh:
+			return err
+		default:
+			return nil
+		}
+	}, opt)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ShardsError is returned by ForEach* methods used with
+// WithContinueOnError when fn fails on some of the shards.
+type ShardsError struct {
+	// Errors contains errors of failed shards sorted by shard id.
+	Errors []*ShardError
+
+	mu sync.Mutex
+}
+
+func (e *ShardsError) add(shardId int64, err error) {
+	e.mu.Lock()
+	e.Errors = append(e.Errors, &ShardError{
+		ShardId: shardId,
+		Err:     err,
+	})
+	e.mu.Unlock()
+}
+
+func (e *ShardsError) sort() {
+	sort.Slice(e.Errors, func(i, j int) bool {
+		return e.Errors[i].ShardId < e.Errors[j].ShardId
+	})
+}
+
+func (e *ShardsError) Error() string {
+	var b bytes.Buffer
+	b.WriteString("sharding: ")
+	b.WriteString(strconv.Itoa(len(e.Errors)))
+	b.WriteString(" shard(s) failed:")
+	for i, err := range e.Errors {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(" shard")
+		b.WriteString(strconv.FormatInt(err.ShardId, 10))
+		b.WriteString(": ")
+		b.WriteString(err.Err.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns errors of the failed shards.
+func (e *ShardsError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
@@ -0,0 +1,344 @@
+package sharding
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// CollectShards concurrently runs the query on every shard in the cluster
+// and returns rows from all shards concatenated in shard order. The model
+// allocates a slice to decode rows of a single shard into; if it is nil
+// a new empty slice is used. Params such as ?shard are substituted
+// for each shard as usual. Like other read helpers, e.g. CountRows, it
+// includes servers disabled with DisableServer, so the result is never
+// silently missing their shards.
+func CollectShards[T any](
+	cl *Cluster, model func() *[]T, query interface{}, params ...interface{},
+) ([]T, error) {
+	if model == nil {
+		model = func() *[]T {
+			return new([]T)
+		}
+	}
+
+	perShard := make([][]T, len(cl.shards))
+	err := cl.ForEachShard(func(shard *pg.DB) error {
+		rows := model()
+		_, err := shard.Query(rows, query, params...)
+		if err != nil {
+			return err
+		}
+		perShard[ShardId(shard)] = *rows
+		return nil
+	}, WithDisabled())
+	if err != nil {
+		return nil, err
+	}
+
+	var n int
+	for _, rows := range perShard {
+		n += len(rows)
+	}
+	all := make([]T, 0, n)
+	for _, rows := range perShard {
+		all = append(all, rows...)
+	}
+	return all, nil
+}
+
+// ShardAccumulator gathers values produced by ForEach* callbacks, which
+// run concurrently. Close over it in the callback and call Add instead of
+// appending to a shared slice, which is a data race without a mutex.
+// The zero value is ready to use.
+type ShardAccumulator[T any] struct {
+	mu     sync.Mutex
+	values []T
+}
+
+// Add appends the values. It is safe to call from multiple goroutines.
+func (a *ShardAccumulator[T]) Add(values ...T) {
+	a.mu.Lock()
+	a.values = append(a.values, values...)
+	a.mu.Unlock()
+}
+
+// Results returns a copy of the added values in order they were added.
+// Values added by different shards are interleaved in no particular order.
+func (a *ShardAccumulator[T]) Results() []T {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]T(nil), a.values...)
+}
+
+// ShardResult is the result of calling fn on a shard
+// in ForEachShardStream.
+type ShardResult[T any] struct {
+	ShardId int64
+	Value   T
+	Err     error
+}
+
+// ForEachShardStream calls the fn on each shard like ForEachShard and
+// sends result of every shard to the returned channel as soon as the
+// shard is processed, e.g. to render results of a slow aggregation
+// progressively. Every shard is sent once with the result of the last
+// attempt when WithRetry or WithReconnect is used.
+// The channel is closed after all shards are processed. It is buffered
+// for all shards, so abandoning it does not leak goroutines.
+func ForEachShardStream[T any](
+	cl *Cluster, fn func(shard *pg.DB) (T, error), opts ...ForEachOption,
+) <-chan ShardResult[T] {
+	if fn == nil {
+		panic("sharding: ForEachShardStream is called with nil fn")
+	}
+
+	ch := make(chan ShardResult[T], len(cl.shards))
+	// Values are sent by the observer once per shard,
+	// so retried shards are reported only with the last attempt.
+	values := make([]T, len(cl.shards))
+	opt := newForEachOptions(opts)
+	opt.observers = append(opt.observers, func(id int64, dur time.Duration, err error) {
+		ch <- ShardResult[T]{
+			ShardId: id,
+			Value:   values[id],
+			Err:     err,
+		}
+	})
+	go func() {
+		defer close(ch)
+		_ = cl.forEachShard(cl.shards, cl.shardServers, func(shard *pg.DB) error {
+			v, err := fn(shard)
+			values[ShardId(shard)] = v
+			return err
+		}, opt)
+	}()
+	return ch
+}
+
+// ShardOutcome is the result of calling fn on a shard
+// in ForEachShardResult.
+type ShardOutcome struct {
+	ShardId  int64
+	Err      error
+	Duration time.Duration
+}
+
+// ForEachShardResult calls the fn on each shard like ForEachShard, but
+// never stops on errors and returns outcome of every shard sorted by
+// shard id. Shards on servers disabled with DisableServer are omitted
+// unless WithDisabled option is used. Shards that were not processed,
+// because the ctx is done, are reported with the ctx error.
+func (cl *Cluster) ForEachShardResult(
+	fn func(shard *pg.DB) error, opts ...ForEachOption,
+) []ShardOutcome {
+	if fn == nil {
+		panic("sharding: ForEachShardResult is called with nil fn")
+	}
+
+	outcomes := make([]ShardOutcome, len(cl.shards))
+	done := make([]bool, len(cl.shards))
+	opt := newForEachOptions(opts)
+	opt.stopOnError = false
+	opt.observers = append(opt.observers, func(id int64, dur time.Duration, err error) {
+		outcomes[id] = ShardOutcome{
+			ShardId:  id,
+			Err:      err,
+			Duration: dur,
+		}
+		done[id] = true
+	})
+	_ = cl.forEachShard(cl.shards, cl.shardServers, fn, opt)
+
+	ctxErr := cl.ctxErr(opt)
+	disabled := cl.loadDisabled()
+	res := make([]ShardOutcome, 0, len(outcomes))
+	for i, outcome := range outcomes {
+		if done[i] {
+			res = append(res, outcome)
+			continue
+		}
+		if ctxErr == nil {
+			continue
+		}
+		if _, ok := disabled.servers[cl.shardServers[i]]; ok && !opt.includeDisabled {
+			continue
+		}
+		res = append(res, ShardOutcome{
+			ShardId: int64(i),
+			Err:     ctxErr,
+		})
+	}
+	return res
+}
+
+// Partition concurrently queries load of every shard with the loadFn and
+// returns id of the least loaded shard, e.g. to place a new tenant.
+// Shards with equal load are resolved in favor of the smaller shard id.
+// Shards on servers disabled with DisableServer are not considered.
+func (cl *Cluster) Partition(
+	ctx context.Context, loadFn func(shard *pg.DB) (int64, error),
+) (int64, error) {
+	if loadFn == nil {
+		panic("sharding: Partition is called with nil fn")
+	}
+
+	var mu sync.Mutex
+	shardId := int64(-1)
+	var minLoad int64
+	err := cl.ForEachShard(func(shard *pg.DB) error {
+		load, err := loadFn(shard)
+		if err != nil {
+			return err
+		}
+
+		id := ShardId(shard)
+		mu.Lock()
+		if shardId == -1 || load < minLoad || (load == minLoad && id < shardId) {
+			shardId = id
+			minLoad = load
+		}
+		mu.Unlock()
+		return nil
+	}, WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	if shardId == -1 {
+		return 0, errors.New("sharding: all servers are disabled")
+	}
+	return shardId, nil
+}
+
+// ForEachShardWithLimit concurrently calls the fn on each shard in the
+// cluster until the ctx is done. Unlike ForEachShard it does not wait
+// for shards that did not finish in time and returns results gathered so
+// far keyed by shard id together with sorted ids of shards that have no
+// result, because they either did not finish or failed. The returned
+// error is the first error returned by fn or the ctx error. It is useful
+// for best effort aggregations that must fit into a time budget.
+func ForEachShardWithLimit[T any](
+	ctx context.Context,
+	cl *Cluster,
+	fn func(ctx context.Context, shard *pg.DB) (T, error),
+	opts ...ForEachOption,
+) (results map[int64]T, unfinished []int64, err error) {
+	if fn == nil {
+		panic("sharding: ForEachShardWithLimit is called with nil fn")
+	}
+
+	var mu sync.Mutex
+	var stopped bool
+	results = make(map[int64]T, len(cl.shards))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cl.ForEachShard(func(shard *pg.DB) error {
+			res, err := fn(ctx, shard)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			if !stopped {
+				results[ShardId(shard)] = res
+			}
+			mu.Unlock()
+			return nil
+		}, append(opts[:len(opts):len(opts)], WithContext(ctx))...)
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+
+	for id := range cl.shards {
+		if _, ok := results[int64(id)]; !ok {
+			unfinished = append(unfinished, int64(id))
+		}
+	}
+	return results, unfinished, err
+}
+
+// MergeSortedShards merges rows that are already sorted on each shard
+// (e.g. with ORDER BY) into a single globally sorted slice using k-way
+// merge. Rows that are equal according to less keep shard order.
+func MergeSortedShards[T any](perShard [][]T, less func(a, b T) bool) []T {
+	var n int
+	h := &mergeHeap[T]{
+		perShard: perShard,
+		less:     less,
+	}
+	for i, rows := range perShard {
+		n += len(rows)
+		if len(rows) > 0 {
+			h.items = append(h.items, mergeItem{shard: i})
+		}
+	}
+	heap.Init(h)
+
+	merged := make([]T, 0, n)
+	for h.Len() > 0 {
+		item := &h.items[0]
+		merged = append(merged, perShard[item.shard][item.pos])
+		item.pos++
+		if item.pos < len(perShard[item.shard]) {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return merged
+}
+
+type mergeItem struct {
+	shard int
+	pos   int
+}
+
+type mergeHeap[T any] struct {
+	perShard [][]T
+	items    []mergeItem
+	less     func(a, b T) bool
+}
+
+func (h *mergeHeap[T]) Len() int {
+	return len(h.items)
+}
+
+func (h *mergeHeap[T]) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	va, vb := h.perShard[a.shard][a.pos], h.perShard[b.shard][b.pos]
+	if h.less(va, vb) {
+		return true
+	}
+	if h.less(vb, va) {
+		return false
+	}
+	return a.shard < b.shard
+}
+
+func (h *mergeHeap[T]) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *mergeHeap[T]) Push(x interface{}) {
+	h.items = append(h.items, x.(mergeItem))
+}
+
+func (h *mergeHeap[T]) Pop() interface{} {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items = h.items[:n-1]
+	return item
+}
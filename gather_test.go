@@ -0,0 +1,88 @@
+package sharding_test
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/go-pg/sharding"
+)
+
+func TestMergeSortedShards(t *testing.T) {
+	type row struct {
+		shard int
+		time  int
+	}
+
+	less := func(a, b row) bool {
+		return a.time < b.time
+	}
+
+	tests := []struct {
+		perShard [][]row
+		wanted   []row
+	}{
+		{nil, []row{}},
+		{[][]row{nil, {}}, []row{}},
+		{
+			[][]row{{{0, 1}, {0, 4}, {0, 7}}},
+			[]row{{0, 1}, {0, 4}, {0, 7}},
+		},
+		{
+			[][]row{
+				{{0, 1}, {0, 4}, {0, 7}},
+				nil,
+				{{2, 2}, {2, 3}, {2, 9}},
+				{{3, 0}},
+			},
+			[]row{{3, 0}, {0, 1}, {2, 2}, {2, 3}, {0, 4}, {0, 7}, {2, 9}},
+		},
+		{
+			[][]row{
+				{{0, 1}, {0, 2}},
+				{{1, 1}, {1, 2}},
+			},
+			[]row{{0, 1}, {1, 1}, {0, 2}, {1, 2}},
+		},
+	}
+
+	for _, test := range tests {
+		got := sharding.MergeSortedShards(test.perShard, less)
+		if !reflect.DeepEqual(got, test.wanted) {
+			t.Errorf("got %v, wanted %v", got, test.wanted)
+		}
+	}
+}
+
+func TestShardAccumulator(t *testing.T) {
+	var acc sharding.ShardAccumulator[int]
+	if got := acc.Results(); len(got) != 0 {
+		t.Fatalf("got %v, wanted no results", got)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			acc.Add(i, i+10)
+		}(i)
+	}
+	wg.Wait()
+
+	got := acc.Results()
+	sort.Ints(got)
+	wanted := make([]int, 20)
+	for i := range wanted {
+		wanted[i] = i
+	}
+	if !reflect.DeepEqual(got, wanted) {
+		t.Fatalf("got %v, wanted %v", got, wanted)
+	}
+
+	got[0] = -1
+	if acc.Results()[0] == -1 {
+		t.Fatalf("Results must return a copy")
+	}
+}
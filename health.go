@@ -0,0 +1,221 @@
+package sharding
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// ErrServerUnreachable is returned by ForEach* methods for servers that
+// are marked unreachable by AllowPartial option.
+var ErrServerUnreachable = errors.New("sharding: server is unreachable")
+
+const defaultPingTimeout = 5 * time.Second
+
+// unreachableState is shared by the cluster and its copies.
+type unreachableState struct {
+	mu sync.Mutex
+	v  atomic.Value // map[*pg.DB]error
+}
+
+func (cl *Cluster) initUnreachable() {
+	cl.unreachable = new(unreachableState)
+
+	ctx, cancel := cl.pingContext(context.Background())
+	defer cancel()
+
+	errs := cl.ping(ctx, cl.servers)
+	unreachable := make(map[*pg.DB]error)
+	for _, db := range cl.servers {
+		if errs[db] != nil {
+			unreachable[db] = errs[db]
+		}
+	}
+	if len(unreachable) == len(cl.servers) {
+		panic(fmt.Sprintf("sharding: all servers are unreachable: %s", errs[cl.servers[0]]))
+	}
+	cl.unreachable.v.Store(unreachable)
+}
+
+func (cl *Cluster) pingContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := cl.opt.PingTimeout
+	if timeout == 0 {
+		timeout = defaultPingTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// UnreachableServers returns servers that are marked unreachable by
+// AllowPartial option together with ping errors.
+func (cl *Cluster) UnreachableServers() map[*pg.DB]error {
+	if cl.unreachable == nil {
+		return nil
+	}
+	m, _ := cl.unreachable.v.Load().(map[*pg.DB]error)
+	return m
+}
+
+func (cl *Cluster) isUnreachable(db *pg.DB) bool {
+	_, ok := cl.UnreachableServers()[db]
+	return ok
+}
+
+// RecheckServers pings servers that are marked unreachable by
+// AllowPartial option and marks the ones that respond as reachable, so
+// ForEach* methods process their shards again. Every ping is bounded by
+// ClusterOptions.PingTimeout. It returns servers that are still
+// unreachable together with ping errors. Call it periodically or when
+// a server is known to be back.
+func (cl *Cluster) RecheckServers(ctx context.Context) map[*pg.DB]error {
+	if cl.unreachable == nil {
+		return nil
+	}
+
+	cl.unreachable.mu.Lock()
+	defer cl.unreachable.mu.Unlock()
+
+	old := cl.UnreachableServers()
+	if len(old) == 0 {
+		return old
+	}
+	servers := make([]*pg.DB, 0, len(old))
+	for db := range old {
+		servers = append(servers, db)
+	}
+
+	ctx, cancel := cl.pingContext(ctx)
+	defer cancel()
+
+	errs := cl.ping(ctx, servers)
+	unreachable := make(map[*pg.DB]error)
+	for _, db := range servers {
+		if errs[db] != nil {
+			unreachable[db] = errs[db]
+		}
+	}
+	cl.unreachable.v.Store(unreachable)
+	return unreachable
+}
+
+// Ping concurrently executes SELECT 1 on every server in the cluster,
+// including disabled ones, and returns the result for each server.
+// Servers that did not respond before the ctx is done get ctx.Err().
+func (cl *Cluster) Ping(ctx context.Context) map[*pg.DB]error {
+	return cl.ping(ctx, cl.servers)
+}
+
+func (cl *Cluster) ping(ctx context.Context, servers []*pg.DB) map[*pg.DB]error {
+	type result struct {
+		db  *pg.DB
+		err error
+	}
+
+	ch := make(chan result, len(servers))
+	for _, db := range servers {
+		go func(db *pg.DB) {
+			_, err := db.WithContext(ctx).Exec(`SELECT 1`)
+			ch <- result{db, err}
+		}(db)
+	}
+
+	errs := make(map[*pg.DB]error, len(servers))
+	for range servers {
+		select {
+		case res := <-ch:
+			errs[res.db] = res.err
+		case <-ctx.Done():
+			for _, db := range servers {
+				if _, ok := errs[db]; !ok {
+					errs[db] = ctx.Err()
+				}
+			}
+			return errs
+		}
+	}
+	return errs
+}
+
+// HealthHandlerOptions configures ClusterHealthHandler.
+type HealthHandlerOptions struct {
+	// Timeout for pinging servers. Default is 1 second.
+	Timeout time.Duration
+	// Quorum is minimal number of reachable servers for the cluster to
+	// be considered healthy. Default is all servers.
+	Quorum int
+}
+
+func (opt *HealthHandlerOptions) init(cl *Cluster) {
+	if opt.Timeout == 0 {
+		opt.Timeout = time.Second
+	}
+	if opt.Quorum == 0 {
+		opt.Quorum = len(cl.servers)
+	}
+}
+
+type healthResponse struct {
+	Healthy bool           `json:"healthy"`
+	Servers []serverHealth `json:"servers"`
+}
+
+type serverHealth struct {
+	Addr     string `json:"addr"`
+	Database string `json:"database"`
+	Healthy  bool   `json:"healthy"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ClusterHealthHandler returns http.Handler suitable for readiness
+// probes. It pings the cluster servers and responds with 200 OK when at
+// least opt.Quorum servers are reachable and with 503 Service Unavailable
+// otherwise. Body is JSON with overall healthy flag and status of each
+// server.
+func ClusterHealthHandler(cl *Cluster, opt *HealthHandlerOptions) http.Handler {
+	// Defaults are set on a copy, so the caller's options are not modified.
+	var cp HealthHandlerOptions
+	if opt != nil {
+		cp = *opt
+	}
+	cp.init(cl)
+	opt = &cp
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), opt.Timeout)
+		defer cancel()
+
+		errs := cl.Ping(ctx)
+
+		var resp healthResponse
+		var healthy int
+		for _, db := range cl.servers {
+			dbOpt := db.Options()
+			server := serverHealth{
+				Addr:     dbOpt.Addr,
+				Database: dbOpt.Database,
+				Healthy:  errs[db] == nil,
+			}
+			if errs[db] != nil {
+				server.Error = errs[db].Error()
+			} else {
+				healthy++
+			}
+			resp.Servers = append(resp.Servers, server)
+		}
+		resp.Healthy = healthy >= opt.Quorum
+
+		w.Header().Set("Content-Type", "application/json")
+		if resp.Healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+}
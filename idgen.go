@@ -73,6 +73,11 @@ func (g *IdGen) SplitId(id int64) (tm time.Time, shardId int64, seqId int64) {
 	return
 }
 
+// shardId is like SplitId, but only extracts shard id.
+func (g *IdGen) shardId(id int64) int64 {
+	return (id >> g.seqBits) & g.shardMask
+}
+
 //------------------------------------------------------------------------------
 
 // SplitId splits id into time, shard id, and sequence id.
@@ -103,6 +108,7 @@ type ShardIdGen struct {
 	shard int64
 	seq   int64
 	gen   *IdGen
+	clock func() time.Time
 }
 
 // NewShardIdGen returns id generator for the shard.
@@ -113,9 +119,31 @@ func NewShardIdGen(shard int64, gen *IdGen) *ShardIdGen {
 	return &ShardIdGen{
 		shard: shard % int64(gen.NumShards()),
 		gen:   gen,
+		clock: time.Now,
+	}
+}
+
+// WithClock returns a copy of the generator that uses the clock instead
+// of time.Now in Next, e.g. to generate reproducible ids in tests.
+// Sequence of the copy starts from zero.
+func (g *ShardIdGen) WithClock(clock func() time.Time) *ShardIdGen {
+	return &ShardIdGen{
+		shard: g.shard,
+		gen:   g.gen,
+		clock: clock,
 	}
 }
 
+// Next returns incremental id for the current time of the clock.
+func (g *ShardIdGen) Next() int64 {
+	return g.NextId(g.clock())
+}
+
+// ResetSeq resets the sequence, so the next id gets sequence id zero.
+func (g *ShardIdGen) ResetSeq() {
+	atomic.StoreInt64(&g.seq, 0)
+}
+
 // NextId returns incremental id for the time. Note that you can only
 // generate 4096 unique numbers per millisecond.
 func (g *ShardIdGen) NextId(tm time.Time) int64 {
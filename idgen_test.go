@@ -140,3 +140,31 @@ func TestCollision(t *testing.T) {
 		m[id] = struct{}{}
 	}
 }
+
+func TestClock(t *testing.T) {
+	tm := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	gen := sharding.NewShardIdGen(5, nil).WithClock(func() time.Time {
+		return tm
+	})
+
+	first := gen.Next()
+	if second := gen.Next(); second != first+1 {
+		t.Errorf("got %d, wanted %d", second, first+1)
+	}
+
+	gotTm, shardId, seqId := gen.SplitId(first)
+	if !gotTm.Equal(tm) {
+		t.Errorf("got %s, wanted %s", gotTm, tm)
+	}
+	if shardId != 5 {
+		t.Errorf("got shard %d, wanted 5", shardId)
+	}
+	if seqId != 0 {
+		t.Errorf("got seq %d, wanted 0", seqId)
+	}
+
+	gen.ResetSeq()
+	if id := gen.Next(); id != first {
+		t.Errorf("got %d, wanted %d", id, first)
+	}
+}
@@ -0,0 +1,38 @@
+package sharding
+
+import (
+	"github.com/go-pg/pg"
+)
+
+// TryAdvisoryLock tries to take session-level PostgreSQL advisory lock
+// with the key on the shard without waiting, e.g. to run a singleton job
+// per shard. The lock is namespaced by shard id, so the same key on
+// shards placed in the same database does not collide. It returns false
+// if the lock is held by another session.
+//
+// Session-level locks belong to the connection that took them, so the
+// lock is taken on a connection pinned with Pin. The returned unlock
+// releases the lock and returns the connection to the pool; it must be
+// called when the lock is no longer needed. The lock is also released by
+// the server if the connection is lost.
+func (cl *Cluster) TryAdvisoryLock(
+	number int64, key int32,
+) (unlock func() error, ok bool, err error) {
+	shard, release, err := cl.Pin(number)
+	if err != nil {
+		return nil, false, err
+	}
+
+	_, err = shard.QueryOne(pg.Scan(&ok), `SELECT pg_try_advisory_lock(?shard_id, ?)`, key)
+	if err != nil || !ok {
+		release()
+		return nil, false, err
+	}
+
+	unlock = func() error {
+		defer release()
+		_, err := shard.Exec(`SELECT pg_advisory_unlock(?shard_id, ?)`, key)
+		return err
+	}
+	return unlock, true, nil
+}
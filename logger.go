@@ -0,0 +1,45 @@
+package sharding
+
+import (
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// QueryLogger logs queries executed on cluster shards.
+type QueryLogger interface {
+	// LogQuery is called after the query is executed on the shard.
+	// Query is formatted with shard params and, unless params are
+	// redacted, with args.
+	LogQuery(shardId int64, query string, args []interface{}, dur time.Duration, err error)
+}
+
+func (cl *Cluster) addQueryLogger(shard *pg.DB, id int64) {
+	logger := cl.opt.QueryLogger
+	redact := cl.opt.RedactParams
+	threshold := cl.opt.SlowQueryThreshold
+	shard.OnQueryProcessed(func(ev *pg.QueryProcessedEvent) {
+		dur := time.Since(ev.StartTime)
+		if dur < threshold {
+			return
+		}
+
+		var query string
+		var args []interface{}
+		var err error
+		if redact {
+			query, err = ev.UnformattedQuery()
+			if err == nil {
+				query = string(shard.FormatQuery(nil, query))
+			}
+		} else {
+			query, err = ev.FormattedQuery()
+			args = ev.Params
+		}
+		if err != nil {
+			query = err.Error()
+		}
+
+		logger.LogQuery(id, query, args, dur, ev.Error)
+	})
+}
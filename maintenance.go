@@ -0,0 +1,207 @@
+package sharding
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-pg/pg"
+)
+
+// ErrServerDisabled is returned for shards on servers disabled with
+// DisableServer by methods that write to every shard.
+var ErrServerDisabled = errors.New("sharding: server is disabled")
+
+// disabledState is shared by the cluster and its copies
+// returned by WithContext.
+type disabledState struct {
+	mu sync.Mutex
+	v  atomic.Value // *disabledServers
+	// readOnly contains read-only pools opened by DisableServer keyed
+	// by the server. They are closed with the cluster.
+	readOnly map[*pg.DB]*pg.DB
+}
+
+type disabledServers struct {
+	servers map[*pg.DB]struct{}
+	// shards maps id of the shard on the disabled server to the same
+	// shard on the read-only db.
+	shards map[int64]*pg.DB
+}
+
+// DisableServer disables the db for maintenance. Shard and SplitShard
+// route shards that are placed on the db to a separate pool of
+// connections to the db with default_transaction_read_only enabled, so
+// reads keep working while writes are rejected by the server. The pool
+// is opened once per server and is closed with the cluster.
+//
+// ForEach* methods skip disabled servers unless WithDisabled option
+// is used.
+func (cl *Cluster) DisableServer(db *pg.DB) {
+	cl.disableServer(db, nil)
+}
+
+// DisableServerReadOnly is like DisableServer, but routes shards that
+// are placed on the db to the readOnly db, e.g. a replica of the db.
+// The readOnly db is not closed by the cluster.
+func (cl *Cluster) DisableServerReadOnly(db, readOnly *pg.DB) {
+	if readOnly == nil {
+		panic("sharding: DisableServerReadOnly is called with nil readOnly")
+	}
+	cl.disableServer(db, readOnly)
+}
+
+func (cl *Cluster) disableServer(db, readOnly *pg.DB) {
+	db = cl.server(db)
+	if db == nil {
+		return
+	}
+
+	cl.disabled.mu.Lock()
+	defer cl.disabled.mu.Unlock()
+
+	if readOnly == nil {
+		readOnly = cl.disabled.readOnlyPool(db)
+	}
+
+	old := cl.loadDisabled()
+	ds := &disabledServers{
+		servers: make(map[*pg.DB]struct{}, len(old.servers)+1),
+		shards:  make(map[int64]*pg.DB, len(old.shards)),
+	}
+	for server := range old.servers {
+		ds.servers[server] = struct{}{}
+	}
+	for id, roShard := range old.shards {
+		ds.shards[id] = roShard
+	}
+
+	ds.servers[db] = struct{}{}
+	for i := range cl.shards {
+		if cl.shardServers[i] == db {
+			ds.shards[int64(i)] = cl.newShard(readOnly, int64(i))
+		}
+	}
+
+	cl.disabled.v.Store(ds)
+}
+
+// readOnlyPool returns the pool of read-only connections to the db.
+// It must be called with the mu held.
+func (st *disabledState) readOnlyPool(db *pg.DB) *pg.DB {
+	if pool, ok := st.readOnly[db]; ok {
+		return pool
+	}
+
+	opt := *db.Options()
+	onConnect := opt.OnConnect
+	opt.OnConnect = func(conn *pg.DB) error {
+		if onConnect != nil {
+			if err := onConnect(conn); err != nil {
+				return err
+			}
+		}
+		_, err := conn.Exec(`SET default_transaction_read_only TO on`)
+		return err
+	}
+	pool := pg.Connect(&opt)
+
+	if st.readOnly == nil {
+		st.readOnly = make(map[*pg.DB]*pg.DB)
+	}
+	st.readOnly[db] = pool
+	return pool
+}
+
+func (st *disabledState) close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var retErr error
+	for db, pool := range st.readOnly {
+		if err := pool.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+		delete(st.readOnly, db)
+	}
+	return retErr
+}
+
+// EnableServer enables the db disabled with DisableServer or
+// DisableServerReadOnly.
+func (cl *Cluster) EnableServer(db *pg.DB) {
+	db = cl.server(db)
+	if db == nil {
+		return
+	}
+
+	cl.disabled.mu.Lock()
+	defer cl.disabled.mu.Unlock()
+
+	old := cl.loadDisabled()
+	ds := &disabledServers{
+		servers: make(map[*pg.DB]struct{}, len(old.servers)),
+		shards:  make(map[int64]*pg.DB, len(old.shards)),
+	}
+	for server := range old.servers {
+		if server != db {
+			ds.servers[server] = struct{}{}
+		}
+	}
+	for id, roShard := range old.shards {
+		if cl.shardServers[id] != db {
+			ds.shards[id] = roShard
+		}
+	}
+
+	cl.disabled.v.Store(ds)
+}
+
+// IsServerDisabled reports whether the db is disabled with DisableServer.
+func (cl *Cluster) IsServerDisabled(db *pg.DB) bool {
+	_, ok := cl.loadDisabled().servers[cl.server(db)]
+	return ok
+}
+
+func (cl *Cluster) isShardDisabled(id int64) bool {
+	_, ok := cl.loadDisabled().shards[id]
+	return ok
+}
+
+func (cl *Cluster) loadDisabled() *disabledServers {
+	ds, _ := cl.disabled.v.Load().(*disabledServers)
+	if ds == nil {
+		return &disabledServers{}
+	}
+	return ds
+}
+
+// route returns the shard with the id or its read-only replacement
+// if the shard's server is disabled.
+func (cl *Cluster) route(id int64) *pg.DB {
+	ds, _ := cl.disabled.v.Load().(*disabledServers)
+	if ds == nil || len(ds.shards) == 0 {
+		return cl.shards[id]
+	}
+	if roShard, ok := ds.shards[id]; ok {
+		if cl.ctx != nil {
+			return roShard.WithContext(cl.ctx)
+		}
+		return roShard
+	}
+	return cl.shards[id]
+}
+
+func (cl *Cluster) enabledServers() []*pg.DB {
+	ds, _ := cl.disabled.v.Load().(*disabledServers)
+	if ds == nil || len(ds.servers) == 0 {
+		return cl.servers
+	}
+	servers := make([]*pg.DB, 0, len(cl.servers))
+	for _, db := range cl.servers {
+		if _, ok := ds.servers[db]; !ok {
+			servers = append(servers, db)
+		}
+	}
+	return servers
+}
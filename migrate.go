@@ -0,0 +1,166 @@
+package sharding
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// migrationsLockId is used as the first key of advisory locks that
+// serialize migrations of the same shard.
+const migrationsLockId = 0x73686172
+
+const initMigrationId = "init"
+
+// EnsureInitialized concurrently executes the ddl statements on every
+// shard that has not been initialized yet. Initialized shards are
+// recorded in ?shard.sharding_migrations table, so it is safe to call
+// EnsureInitialized on every deploy. Shard schema is created if it does
+// not exist. Shards on servers disabled with DisableServer are
+// initialized too, so the cluster is never reported as initialized while
+// some of its shards have no schema.
+func (cl *Cluster) EnsureInitialized(ctx context.Context, ddl []string) error {
+	return cl.ForEachShard(func(shard *pg.DB) error {
+		return applyMigration(ctx, shard, initMigrationId, func(tx *pg.Tx) error {
+			for _, q := range ddl {
+				if _, err := tx.Exec(q); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}, WithDisabled())
+}
+
+// RunMigration calls the fn on every shard where migration with the id
+// is not recorded as applied yet and records the migration after fn
+// succeeds. Unlike EnsureInitialized the fn is not wrapped in a
+// transaction, so it can run long statements such as CREATE INDEX
+// CONCURRENTLY; it must be safe to retry if the process crashes before
+// the migration is recorded. Shards are processed as ForEachShard does,
+// including shards on servers disabled with DisableServer; use
+// WithConcurrency to process more shards per server. Failed shards do
+// not stop other shards and are retried on the next run. If some of the
+// shards were not migrated, it returns *ShardsError that lists them.
+//
+// progress, if not nil, is called after each shard is migrated with
+// number of migrated shards and total number of shards in the cluster.
+// Calls are serialized.
+func (cl *Cluster) RunMigration(
+	ctx context.Context,
+	id string,
+	fn func(shard *pg.DB) error,
+	progress func(done, total int),
+	opts ...ForEachOption,
+) error {
+	if fn == nil {
+		panic("sharding: RunMigration is called with nil fn")
+	}
+
+	opts = append([]ForEachOption{WithDisabled(), WithContinueOnError()}, opts...)
+	opts = append(opts, WithContext(ctx))
+
+	var mu sync.Mutex
+	var done int
+	return cl.ForEachShard(func(shard *pg.DB) error {
+		err := runMigration(ctx, shard, id, fn)
+		if err == nil && progress != nil {
+			mu.Lock()
+			done++
+			progress(done, len(cl.shards))
+			mu.Unlock()
+		}
+		return err
+	}, opts...)
+}
+
+func runMigration(
+	ctx context.Context, shard *pg.DB, id string, fn func(shard *pg.DB) error,
+) error {
+	shard = shard.WithContext(ctx)
+
+	if err := createMigrationsTable(shard); err != nil {
+		return err
+	}
+
+	applied, err := isMigrationApplied(shard, id)
+	if err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	if err := fn(shard); err != nil {
+		return err
+	}
+
+	_, err = shard.Exec(`
+		INSERT INTO ?shard.sharding_migrations (id) VALUES (?)
+		ON CONFLICT (id) DO NOTHING`, id)
+	return err
+}
+
+// applyMigration runs the fn in a transaction on the shard unless
+// migration with the id is already recorded as applied.
+func applyMigration(
+	ctx context.Context, shard *pg.DB, id string, fn func(tx *pg.Tx) error,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return shard.WithContext(ctx).RunInTransaction(func(tx *pg.Tx) error {
+		_, err := tx.Exec(`SELECT pg_advisory_xact_lock(?, ?shard_id)`, migrationsLockId)
+		if err != nil {
+			return err
+		}
+
+		if err := createMigrationsTable(tx); err != nil {
+			return err
+		}
+
+		applied, err := isMigrationApplied(tx, id)
+		if err != nil {
+			return err
+		}
+		if applied {
+			return nil
+		}
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO ?shard.sharding_migrations (id) VALUES (?)`, id)
+		return err
+	})
+}
+
+func createMigrationsTable(db orm.DB) error {
+	queries := []string{
+		`CREATE SCHEMA IF NOT EXISTS ?shard`,
+		`CREATE TABLE IF NOT EXISTS ?shard.sharding_migrations (
+			id text PRIMARY KEY,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`,
+	}
+	for _, q := range queries {
+		if _, err := db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isMigrationApplied(db orm.DB, id string) (bool, error) {
+	var n int
+	_, err := db.QueryOne(pg.Scan(&n), `
+		SELECT count(*) FROM ?shard.sharding_migrations WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,113 @@
+package sharding
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/go-pg/pg"
+)
+
+// ShardNotification is a notification sent with NOTIFY on the shard
+// channel returned by ShardChannel.
+type ShardNotification struct {
+	ShardId int64
+	// Channel is the channel passed to Cluster.Listen.
+	Channel string
+	Payload string
+}
+
+// ShardChannel returns name of the channel that notifications for the
+// shard must be sent to, so Cluster.Listen can tell which shard they
+// originate from, e.g.:
+//
+//	SELECT pg_notify(?, 'payload')
+//
+// with ShardChannel(shard, channel) as the param. PostgreSQL truncates
+// channel names longer than 63 bytes.
+func ShardChannel(shard *pg.DB, channel string) string {
+	return shardChannel(ShardId(shard), channel)
+}
+
+func shardChannel(shardId int64, channel string) string {
+	return "shard" + strconv.FormatInt(shardId, 10) + ":" + channel
+}
+
+// Listen listens for notifications sent to the channel on every shard
+// in the cluster, see ShardChannel, and multiplexes them into the
+// returned Go channel. A single listener connection is opened per
+// server rather than per shard; go-pg pings the connections and
+// reconnects them if they drop, though notifications sent while
+// reconnecting are lost. Servers that are marked unreachable by
+// AllowPartial option are skipped. Listening stops and
+// the returned channel is closed when the ctx is done.
+func (cl *Cluster) Listen(ctx context.Context, channel string) (<-chan ShardNotification, error) {
+	type serverListener struct {
+		ln       *pg.Listener
+		shardIds map[string]int64
+	}
+
+	var listeners []serverListener
+	for _, db := range cl.servers {
+		if cl.isUnreachable(db) {
+			continue
+		}
+
+		shardIds := make(map[string]int64)
+		var channels []string
+		for i, server := range cl.shardServers {
+			if server == db {
+				name := shardChannel(int64(i), channel)
+				shardIds[name] = int64(i)
+				channels = append(channels, name)
+			}
+		}
+
+		ln := db.Listen()
+		if err := ln.Listen(channels...); err != nil {
+			_ = ln.Close()
+			for _, l := range listeners {
+				_ = l.ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, serverListener{
+			ln:       ln,
+			shardIds: shardIds,
+		})
+	}
+
+	ch := make(chan ShardNotification)
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l serverListener) {
+			defer wg.Done()
+			for n := range l.ln.Channel() {
+				shardId, ok := l.shardIds[n.Channel]
+				if !ok {
+					continue
+				}
+				select {
+				case ch <- ShardNotification{
+					ShardId: shardId,
+					Channel: channel,
+					Payload: n.Payload,
+				}:
+				case <-ctx.Done():
+				}
+			}
+		}(l)
+	}
+
+	go func() {
+		<-ctx.Done()
+		for _, l := range listeners {
+			_ = l.ln.Close()
+		}
+		wg.Wait()
+		close(ch)
+	}()
+
+	return ch, nil
+}
@@ -0,0 +1,191 @@
+package sharding
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// PinnedShard is a shard bound to a single connection checked out from
+// the shard's pool. Statements are executed in autocommit mode, so
+// session state such as SET, temporary tables and session-level advisory
+// locks is preserved between them. It implements orm.DB and substitutes
+// shard params like the shard does.
+type PinnedShard struct {
+	shard *pg.DB
+	tx    *pg.Tx
+}
+
+var _ orm.DB = (*PinnedShard)(nil)
+
+// Pin checks out a single connection from the pool of the shard and
+// returns the shard bound to it, so a read that follows a write in the
+// same request is guaranteed to see the write. The connection counts
+// against PoolSize of the shard's server like any other pooled
+// connection.
+//
+// Release must be called when the shard is no longer needed; otherwise
+// the connection is leaked. It rolls back an unfinished transaction,
+// releases session-level advisory locks, drops temporary tables and
+// returns the connection to the pool. Settings changed with SET are not
+// reset, so they must be reverted by the caller. The pinned shard must
+// not be used after release or shared between goroutines.
+func (cl *Cluster) Pin(number int64) (shard *PinnedShard, release func(), err error) {
+	return cl.pin(cl.Shard(number))
+}
+
+func (cl *Cluster) pin(shard *pg.DB) (*PinnedShard, func(), error) {
+	// pg.DB.Begin is the only way to hold a pooled connection; COMMIT
+	// ends the transaction but the connection stays checked out until
+	// Rollback returns it to the pool.
+	tx, err := shard.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.Exec(`COMMIT`); err != nil {
+		_ = tx.Rollback()
+		return nil, nil, err
+	}
+
+	appName := cl.opt.ApplicationName
+	if cl.searchPaths != nil {
+		// Connections of the shard are tagged when they are opened.
+		appName = ""
+	}
+	if appName != "" {
+		appName += "/shard" + strconv.FormatInt(ShardId(shard), 10)
+		if _, err := tx.Exec(`SET application_name TO ?`, appName); err != nil {
+			_ = tx.Rollback()
+			return nil, nil, err
+		}
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			queries := []string{
+				`ROLLBACK`,
+				`SELECT pg_advisory_unlock_all()`,
+				`DISCARD TEMP`,
+			}
+			if appName != "" {
+				queries = append(queries, `RESET application_name`)
+			}
+			for _, q := range queries {
+				if _, err := tx.Exec(q); err != nil {
+					break
+				}
+			}
+			_ = tx.Rollback()
+		})
+	}
+	return &PinnedShard{shard: shard, tx: tx}, release, nil
+}
+
+// Shard returns the shard the connection is checked out from.
+func (s *PinnedShard) Shard() *pg.DB {
+	return s.shard
+}
+
+// ShardId returns id of the shard.
+func (s *PinnedShard) ShardId() int64 {
+	return ShardId(s.shard)
+}
+
+// Model returns new query for the models on the pinned connection.
+func (s *PinnedShard) Model(model ...interface{}) *orm.Query {
+	return s.tx.Model(model...)
+}
+
+// Select selects the model by primary key on the pinned connection.
+func (s *PinnedShard) Select(model interface{}) error {
+	return s.tx.Select(model)
+}
+
+// Insert inserts the models on the pinned connection.
+func (s *PinnedShard) Insert(model ...interface{}) error {
+	return s.tx.Insert(model...)
+}
+
+// Update updates the model by primary key on the pinned connection.
+func (s *PinnedShard) Update(model interface{}) error {
+	return s.tx.Update(model)
+}
+
+// Delete deletes the model by primary key on the pinned connection.
+func (s *PinnedShard) Delete(model interface{}) error {
+	return s.tx.Delete(model)
+}
+
+// ForceDelete forces delete of the model with deleted_at column on the
+// pinned connection.
+func (s *PinnedShard) ForceDelete(model interface{}) error {
+	return s.tx.ForceDelete(model)
+}
+
+// Exec executes the query on the pinned connection.
+func (s *PinnedShard) Exec(query interface{}, params ...interface{}) (orm.Result, error) {
+	return s.tx.Exec(query, params...)
+}
+
+// ExecOne is like Exec, but checks that the query affected only one row.
+func (s *PinnedShard) ExecOne(query interface{}, params ...interface{}) (orm.Result, error) {
+	return s.tx.ExecOne(query, params...)
+}
+
+// Query executes the query on the pinned connection and scans the
+// returned rows into the model.
+func (s *PinnedShard) Query(model, query interface{}, params ...interface{}) (orm.Result, error) {
+	return s.tx.Query(model, query, params...)
+}
+
+// QueryOne is like Query, but checks that the query returned only one row.
+func (s *PinnedShard) QueryOne(model, query interface{}, params ...interface{}) (orm.Result, error) {
+	return s.tx.QueryOne(model, query, params...)
+}
+
+// CopyFrom copies data from the reader to a table on the pinned
+// connection.
+func (s *PinnedShard) CopyFrom(r io.Reader, query interface{}, params ...interface{}) (orm.Result, error) {
+	return s.tx.CopyFrom(r, query, params...)
+}
+
+// CopyTo copies data from a table to the writer on the pinned connection.
+func (s *PinnedShard) CopyTo(w io.Writer, query interface{}, params ...interface{}) (orm.Result, error) {
+	return s.tx.CopyTo(w, query, params...)
+}
+
+// Context returns context of the shard.
+func (s *PinnedShard) Context() context.Context {
+	return s.shard.Context()
+}
+
+// FormatQuery formats the query with shard params like the shard does.
+func (s *PinnedShard) FormatQuery(dst []byte, query string, params ...interface{}) []byte {
+	return s.shard.FormatQuery(dst, query, params...)
+}
+
+// ForEachShardWithConnection is like ForEachShard, but passes to the fn
+// the shard pinned to a single pooled connection like Pin does, so
+// session state such as SET, temporary tables and session-level advisory
+// locks is preserved between statements executed by the fn. The
+// connection is released after the fn returns.
+func (cl *Cluster) ForEachShardWithConnection(
+	fn func(shard *PinnedShard) error, opts ...ForEachOption,
+) error {
+	if fn == nil {
+		panic("sharding: ForEachShardWithConnection is called with nil fn")
+	}
+	return cl.ForEachShard(func(shard *pg.DB) error {
+		pinned, release, err := cl.pin(shard)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return fn(pinned)
+	}, opts...)
+}
@@ -0,0 +1,113 @@
+package sharding
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// serverPools contains pools of connections to the servers opened with
+// ClusterOptions.PoolTimeout, StatementTimeout and RateLimits that are
+// shared by the cluster and its copies.
+type serverPools struct {
+	poolTimeout      time.Duration
+	statementTimeout time.Duration
+
+	mu sync.Mutex
+	m  map[serverPoolKey]*pg.DB
+}
+
+// serverPoolKey identifies the pool. Dbs of the cluster connected to
+// the same server share the pool, so the server gets a single pool;
+// other dbs, e.g. read-only pools of disabled servers, get their own.
+type serverPoolKey struct {
+	server string
+	db     *pg.DB
+}
+
+func newServerPools(opt *ClusterOptions) *serverPools {
+	if opt.PoolTimeout <= 0 && opt.StatementTimeout <= 0 && len(opt.RateLimits) == 0 {
+		return nil
+	}
+	return &serverPools{
+		poolTimeout:      opt.PoolTimeout,
+		statementTimeout: opt.StatementTimeout,
+		m:                make(map[serverPoolKey]*pg.DB),
+	}
+}
+
+// get returns the pool of connections to the db server with the
+// timeouts applied. The pool is shared by dbs connected to the same
+// server if shared is true. Queries executed on connections of the pool
+// take a token from the limiter if it is not nil.
+func (p *serverPools) get(db *pg.DB, shared bool, limiter *tokenBucket) *pg.DB {
+	key := serverPoolKey{db: db}
+	if shared {
+		key = serverPoolKey{server: serverKey(db)}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pool, ok := p.m[key]; ok {
+		return pool
+	}
+
+	opt := *db.Options()
+	if p.poolTimeout > 0 {
+		opt.PoolTimeout = p.poolTimeout
+	}
+	if p.statementTimeout > 0 {
+		ms := int64(p.statementTimeout / time.Millisecond)
+		if ms == 0 {
+			// Zero disables statement_timeout.
+			ms = 1
+		}
+		onConnect := opt.OnConnect
+		opt.OnConnect = func(conn *pg.DB) error {
+			if onConnect != nil {
+				if err := onConnect(conn); err != nil {
+					return err
+				}
+			}
+			_, err := conn.Exec(`SET statement_timeout TO ?`, ms)
+			return err
+		}
+	}
+	if limiter != nil {
+		dial := opt.Dialer
+		if dial == nil {
+			dialer := &net.Dialer{
+				Timeout:   opt.DialTimeout,
+				KeepAlive: 5 * time.Minute,
+			}
+			dial = dialer.Dial
+		}
+		opt.Dialer = func(network, addr string) (net.Conn, error) {
+			cn, err := dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &rateLimitedConn{Conn: cn, limiter: limiter}, nil
+		}
+	}
+	pool := pg.Connect(&opt)
+	p.m[key] = pool
+	return pool
+}
+
+func (p *serverPools) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var retErr error
+	for key, pool := range p.m {
+		if err := pool.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+		delete(p.m, key)
+	}
+	return retErr
+}
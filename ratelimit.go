@@ -0,0 +1,186 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// ErrRateLimited is returned when the server's rate limit is exceeded
+// and RateLimit.FailFast is set.
+var ErrRateLimited error = rateLimitedError{}
+
+// rateLimitedError implements pg.Error, so go-pg does not close the
+// connection the query was not sent to.
+type rateLimitedError struct{}
+
+func (rateLimitedError) Error() string {
+	return "sharding: rate limit exceeded"
+}
+
+func (e rateLimitedError) Field(k byte) string {
+	switch k {
+	case 'S':
+		return "ERROR"
+	case 'M':
+		return e.Error()
+	}
+	return ""
+}
+
+func (rateLimitedError) IntegrityViolation() bool {
+	return false
+}
+
+// RateLimit configures token bucket rate limiter of a server.
+type RateLimit struct {
+	// Rate is number of calls per second. It must be positive.
+	Rate float64
+	// Burst is max number of calls that can be made at once.
+	// Default is 1.
+	Burst int
+	// FailFast makes calls fail with ErrRateLimited instead of
+	// waiting when the limit is exceeded.
+	FailFast bool
+}
+
+type tokenBucket struct {
+	opt *RateLimit
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(opt *RateLimit) *tokenBucket {
+	if opt.Burst == 0 {
+		opt.Burst = 1
+	}
+	return &tokenBucket{
+		opt:    opt,
+		tokens: float64(opt.Burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long to wait before using it.
+// It returns false when the token is not available and FailFast is set.
+func (b *tokenBucket) reserve() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.opt.Rate
+	if burst := float64(b.opt.Burst); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if b.opt.FailFast {
+		return 0, false
+	}
+	b.tokens--
+	return time.Duration(-b.tokens / b.opt.Rate * float64(time.Second)), true
+}
+
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	b.tokens++
+	b.mu.Unlock()
+}
+
+func (b *tokenBucket) wait(ctx context.Context) error {
+	d, ok := b.reserve()
+	if !ok {
+		return ErrRateLimited
+	}
+	if err := sleep(ctx, d); err != nil {
+		b.cancel()
+		return err
+	}
+	return nil
+}
+
+func checkRateLimits(limits map[*pg.DB]*RateLimit) {
+	for db, limit := range limits {
+		if limit != nil && !(limit.Rate > 0) {
+			panic(fmt.Sprintf(
+				"sharding: rate limit of %s must be positive, got %v", serverKey(db), limit.Rate))
+		}
+	}
+}
+
+func (cl *Cluster) initRateLimits() {
+	if len(cl.opt.RateLimits) == 0 {
+		return
+	}
+
+	cl.limiters = make(map[*pg.DB]*tokenBucket, len(cl.opt.RateLimits))
+	for db, limit := range cl.opt.RateLimits {
+		if server := cl.server(db); server != nil && limit != nil {
+			cl.limiters[server] = newTokenBucket(limit)
+		}
+	}
+}
+
+// rateLimitedConn takes a token from the limiter before a query is sent
+// to the server. Waiting for the token is bounded by the write deadline
+// set by go-pg from pg.Options.WriteTimeout.
+type rateLimitedConn struct {
+	net.Conn
+	limiter *tokenBucket
+
+	deadline time.Time
+}
+
+func (cn *rateLimitedConn) SetDeadline(t time.Time) error {
+	cn.deadline = t
+	return cn.Conn.SetDeadline(t)
+}
+
+func (cn *rateLimitedConn) SetWriteDeadline(t time.Time) error {
+	cn.deadline = t
+	return cn.Conn.SetWriteDeadline(t)
+}
+
+func (cn *rateLimitedConn) Write(b []byte) (int, error) {
+	// go-pg writes every message in a single call. Simple queries start
+	// with 'Q' and executions of prepared statements with 'B'.
+	if len(b) > 0 && (b[0] == 'Q' || b[0] == 'B') {
+		ctx := context.Background()
+		if !cn.deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, cn.deadline)
+			defer cancel()
+		}
+		if err := cn.limiter.wait(ctx); err != nil {
+			if err == context.DeadlineExceeded {
+				err = os.ErrDeadlineExceeded
+			}
+			return 0, err
+		}
+	}
+	return cn.Conn.Write(b)
+}
+
+// WaitRateLimit takes a token from the rate limiter of the shard's server
+// configured with ClusterOptions.RateLimits. It blocks until the token is
+// available or the ctx is done, or returns ErrRateLimited if the limit
+// has FailFast set. Queries executed on shards take tokens themselves;
+// use WaitRateLimit to pace other work that loads the server.
+func (cl *Cluster) WaitRateLimit(ctx context.Context, shard *pg.DB) error {
+	b := cl.limiters[cl.shardServers[ShardId(shard)]]
+	if b == nil {
+		return nil
+	}
+	return b.wait(ctx)
+}
@@ -0,0 +1,129 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/go-pg/pg"
+)
+
+// ShardMove describes moving the shard from one server to another.
+type ShardMove struct {
+	ShardId int64
+	From    *pg.DB
+	To      *pg.DB
+}
+
+// RebalancePlan returns moves that change placement of shards in the
+// cluster to the placement in the target cluster ordered by shard id.
+// Servers are matched by network, address, user and database. Both
+// clusters must have the same number of shards.
+func (cl *Cluster) RebalancePlan(target *Cluster) ([]ShardMove, error) {
+	if len(cl.shards) != len(target.shards) {
+		return nil, errors.New("sharding: clusters have different number of shards")
+	}
+
+	var plan []ShardMove
+	for i, from := range cl.shardServers {
+		to := target.shardServers[i]
+		if serverKey(from) != serverKey(to) {
+			plan = append(plan, ShardMove{
+				ShardId: int64(i),
+				From:    from,
+				To:      to,
+			})
+		}
+	}
+	return plan, nil
+}
+
+// ApplyRebalance calls the mover for each move in the plan. Moves from
+// the same server are started in plan order and by default one at a
+// time; use WithConcurrency to run more moves per server. Moves from
+// different servers run concurrently.
+//
+// The ctx passed to the mover is canceled after the first failed move or
+// when the ctx is done, so running moves can be aborted; no new moves
+// are started then. ApplyRebalance waits for running moves and returns moves that
+// did not succeed in plan order, so the rebalance can be resumed by
+// passing them to ApplyRebalance again. Copying data and switching the
+// application to the new placement is the mover's responsibility.
+func (cl *Cluster) ApplyRebalance(
+	ctx context.Context,
+	plan []ShardMove,
+	mover func(ctx context.Context, move ShardMove) error,
+	opts ...ForEachOption,
+) (remaining []ShardMove, err error) {
+	if mover == nil {
+		panic("sharding: ApplyRebalance is called with nil mover")
+	}
+	opt := newForEachOptions(opts)
+
+	var keys []string
+	byServer := make(map[string][]int)
+	for i, move := range plan {
+		key := serverKey(move.From)
+		if _, ok := byServer[key]; !ok {
+			keys = append(keys, key)
+		}
+		byServer[key] = append(byServer[key], i)
+	}
+
+	moveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make([]bool, len(plan))
+	errCh := make(chan error, 1)
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(moves []int) {
+			defer wg.Done()
+
+			var serverWg sync.WaitGroup
+			limit := make(chan struct{}, opt.concurrency)
+			for _, i := range moves {
+				select {
+				case limit <- struct{}{}:
+				case <-moveCtx.Done():
+				}
+				if moveCtx.Err() != nil {
+					break
+				}
+
+				serverWg.Add(1)
+				go func(i int) {
+					defer func() {
+						<-limit
+						serverWg.Done()
+					}()
+					if err := mover(moveCtx, plan[i]); err != nil {
+						cancel()
+						select {
+						case errCh <- err:
+						default:
+						}
+						return
+					}
+					done[i] = true
+				}(i)
+			}
+			serverWg.Wait()
+		}(byServer[key])
+	}
+	wg.Wait()
+
+	for i, move := range plan {
+		if !done[i] {
+			remaining = append(remaining, move)
+		}
+	}
+
+	select {
+	case err = <-errCh:
+	default:
+		err = ctx.Err()
+	}
+	return remaining, err
+}
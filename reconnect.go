@@ -0,0 +1,107 @@
+package sharding
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// ReconnectStats counts shards that were retried by ForEach* methods
+// after their server came back, see WithReconnect.
+type ReconnectStats struct {
+	mu      sync.Mutex
+	retries map[*pg.DB]int
+}
+
+// Retries returns number of retries keyed by server.
+func (s *ReconnectStats) Retries() map[*pg.DB]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	retries := make(map[*pg.DB]int, len(s.retries))
+	for db, n := range s.retries {
+		retries[db] = n
+	}
+	return retries
+}
+
+func (s *ReconnectStats) add(db *pg.DB) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.retries == nil {
+		s.retries = make(map[*pg.DB]int)
+	}
+	s.retries[db]++
+	s.mu.Unlock()
+}
+
+type reconnectOptions struct {
+	maxAttempts int
+	backoff     Backoff
+	stats       *ReconnectStats
+}
+
+// WithReconnect keeps ForEach* methods going when a server drops
+// connections, e.g. during a failover. When fn fails on a shard with a
+// connection error, the server is pinged up to maxAttempts times waiting
+// delay returned by the backoff before each ping, and fn is called again
+// on the same shard once the server responds. If the server does not
+// come back the connection error is returned as usual. Default backoff
+// is ExponentialBackoff(100ms, 5s). If stats is not nil, it counts how
+// many times shards were retried on each server.
+func WithReconnect(maxAttempts int, backoff Backoff, stats *ReconnectStats) ForEachOption {
+	if backoff == nil {
+		backoff = ExponentialBackoff(100*time.Millisecond, 5*time.Second)
+	}
+	return func(opt *forEachOptions) {
+		opt.reconnect = &reconnectOptions{
+			maxAttempts: maxAttempts,
+			backoff:     backoff,
+			stats:       stats,
+		}
+	}
+}
+
+// retry waits for the shard's server to respond and calls fn again while
+// fn fails with a connection error.
+func (opt *reconnectOptions) retry(
+	ctx context.Context, fn func(shard *pg.DB) error, server, shard *pg.DB, err error,
+) error {
+	for attempt := 1; attempt <= opt.maxAttempts && isConnError(err); attempt++ {
+		if err := sleep(ctx, opt.backoff.NextDelay(attempt)); err != nil {
+			return err
+		}
+		if _, pingErr := shard.Exec("SELECT 1"); pingErr != nil {
+			continue
+		}
+		opt.stats.add(server)
+		err = wrapPoolTimeout(fn(shard))
+	}
+	return err
+}
+
+// isConnError reports whether the err means that the connection to the
+// server was lost or could not be established.
+func isConnError(err error) bool {
+	switch err {
+	case nil:
+		return false
+	case io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	if pgErr, ok := err.(pg.Error); ok {
+		code := pgErr.Field('C')
+		return strings.HasPrefix(code, "08") || strings.HasPrefix(code, "57P")
+	}
+	if netErr, ok := err.(net.Error); ok {
+		return !netErr.Timeout()
+	}
+	return false
+}
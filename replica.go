@@ -0,0 +1,189 @@
+package sharding
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// NoReplica is the lag reported by ReplicaLag for shards
+// without a replica.
+const NoReplica time.Duration = -1
+
+func (cl *Cluster) initReplicas() {
+	if len(cl.opt.Replicas) == 0 {
+		return
+	}
+
+	cl.replicas = make(map[*pg.DB]*pg.DB, len(cl.opt.Replicas))
+	for db, replica := range cl.opt.Replicas {
+		if server := cl.server(db); server != nil && replica != nil {
+			cl.replicas[server] = replica
+		}
+	}
+
+	cl.replicaShards = make([]*pg.DB, len(cl.shards))
+	for i := range cl.shards {
+		if replica, ok := cl.replicas[cl.shardServers[i]]; ok {
+			cl.replicaShards[i] = cl.newShard(replica, int64(i))
+		}
+	}
+}
+
+// ReplicaShard maps the number to the corresponding shard on the read
+// replica. If the shard's server has no replica the primary shard is
+// returned. Like Shard, it returns nil if the cluster has no shards.
+func (cl *Cluster) ReplicaShard(number int64) *pg.DB {
+	i, ok := cl.shardIndex(number)
+	if !ok {
+		return nil
+	}
+	if cl.replicaShards != nil {
+		if shard := cl.replicaShards[i]; shard != nil {
+			return shard
+		}
+	}
+	return cl.route(i)
+}
+
+// ReadWriteShard routes queries of a shard by their type: reads made with
+// Query and QueryOne are executed on the read replica and everything else
+// on the primary. Transactions started with Begin or RunInTransaction
+// always use the primary, so reads inside a transaction see its writes.
+// ORM queries started with Model use the primary too, because it is not
+// known in advance whether they read or write.
+type ReadWriteShard struct {
+	primary *pg.DB
+	replica *pg.DB
+}
+
+// ReadWriteShard maps the number to the corresponding shard that routes
+// reads to the read replica like ReplicaShard and writes to the primary
+// like Shard.
+func (cl *Cluster) ReadWriteShard(number int64) *ReadWriteShard {
+	return &ReadWriteShard{
+		primary: cl.Shard(number),
+		replica: cl.ReplicaShard(number),
+	}
+}
+
+// Primary returns the shard on the primary.
+func (s *ReadWriteShard) Primary() *pg.DB {
+	return s.primary
+}
+
+// Replica returns the shard that reads are routed to.
+func (s *ReadWriteShard) Replica() *pg.DB {
+	return s.replica
+}
+
+// ForceWrite returns a copy of the shard that routes reads to the
+// primary too, e.g. to read rows that were just written when replication
+// lag is not acceptable.
+func (s *ReadWriteShard) ForceWrite() *ReadWriteShard {
+	return &ReadWriteShard{
+		primary: s.primary,
+		replica: s.primary,
+	}
+}
+
+// Query executes the query on the replica.
+func (s *ReadWriteShard) Query(model, query interface{}, params ...interface{}) (orm.Result, error) {
+	return s.replica.Query(model, query, params...)
+}
+
+// QueryOne executes the query that returns a single row on the replica.
+func (s *ReadWriteShard) QueryOne(model, query interface{}, params ...interface{}) (orm.Result, error) {
+	return s.replica.QueryOne(model, query, params...)
+}
+
+// Exec executes the query on the primary.
+func (s *ReadWriteShard) Exec(query interface{}, params ...interface{}) (orm.Result, error) {
+	return s.primary.Exec(query, params...)
+}
+
+// ExecOne executes the query that affects a single row on the primary.
+func (s *ReadWriteShard) ExecOne(query interface{}, params ...interface{}) (orm.Result, error) {
+	return s.primary.ExecOne(query, params...)
+}
+
+// Model returns new ORM query for the model on the primary.
+func (s *ReadWriteShard) Model(model ...interface{}) *orm.Query {
+	return s.primary.Model(model...)
+}
+
+// Begin starts a transaction on the primary.
+func (s *ReadWriteShard) Begin() (*pg.Tx, error) {
+	return s.primary.Begin()
+}
+
+// RunInTransaction runs the fn in a transaction on the primary.
+func (s *ReadWriteShard) RunInTransaction(fn func(tx *pg.Tx) error) error {
+	return s.primary.RunInTransaction(fn)
+}
+
+// ReplicaLag concurrently queries replication lag of every replica and
+// returns the lag keyed by shard id. Shards without a replica are
+// reported with NoReplica lag.
+func (cl *Cluster) ReplicaLag(ctx context.Context) (map[int64]time.Duration, error) {
+	var mu sync.Mutex
+	serverLag := make(map[*pg.DB]time.Duration, len(cl.replicas))
+	err := cl.ForEachDB(func(db *pg.DB) error {
+		// db may be bound to the cluster context,
+		// so replicas are looked up by server.
+		server := cl.server(db)
+		replica, ok := cl.replicas[server]
+		if !ok {
+			return nil
+		}
+
+		replica = replica.WithContext(ctx)
+
+		var version int
+		_, err := replica.QueryOne(pg.Scan(&version), `SHOW server_version_num`)
+		if err != nil {
+			return err
+		}
+
+		var seconds float64
+		_, err = replica.QueryOne(pg.Scan(&seconds), replicaLagQuery(version))
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		serverLag[server] = time.Duration(seconds * float64(time.Second))
+		mu.Unlock()
+		return nil
+	}, WithContext(ctx), WithDisabled())
+	if err != nil {
+		return nil, err
+	}
+
+	lag := make(map[int64]time.Duration, len(cl.shards))
+	for i := range cl.shards {
+		if d, ok := serverLag[cl.shardServers[i]]; ok {
+			lag[int64(i)] = d
+		} else {
+			lag[int64(i)] = NoReplica
+		}
+	}
+	return lag, nil
+}
+
+// replicaLagQuery returns the query for replication lag. PostgreSQL 10
+// renamed pg_last_xlog_* functions to pg_last_wal_*.
+func replicaLagQuery(version int) string {
+	receive, replay := "pg_last_wal_receive_lsn()", "pg_last_wal_replay_lsn()"
+	if version < 100000 {
+		receive, replay = "pg_last_xlog_receive_location()", "pg_last_xlog_replay_location()"
+	}
+	return `
+		SELECT CASE
+			WHEN ` + receive + ` = ` + replay + ` THEN 0
+			ELSE coalesce(extract(epoch FROM now() - pg_last_xact_replay_timestamp()), 0)
+		END`
+}
@@ -0,0 +1,67 @@
+package sharding
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/go-pg/pg"
+)
+
+var retryable = struct {
+	mu    sync.RWMutex
+	codes map[string]struct{}
+	funcs []func(err error) bool
+}{
+	codes: map[string]struct{}{
+		"40001": {}, // serialization_failure
+		"40P01": {}, // deadlock_detected
+	},
+}
+
+// IsRetryable reports whether an operation that failed with the err can
+// be retried, because the err is caused by a lost connection, server
+// shutdown (SQLSTATE class 08 and 57P), serialization failure (40001),
+// deadlock (40P01) or matches codes and funcs registered with
+// RegisterRetryableCode and RegisterRetryable. Wrapped errors such as
+// *ShardError are unwrapped.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	retryable.mu.RLock()
+	defer retryable.mu.RUnlock()
+
+	for _, fn := range retryable.funcs {
+		if fn(err) {
+			return true
+		}
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if isConnError(e) {
+			return true
+		}
+		if pgErr, ok := e.(pg.Error); ok {
+			_, ok := retryable.codes[pgErr.Field('C')]
+			return ok
+		}
+	}
+	return false
+}
+
+// RegisterRetryableCode makes IsRetryable report errors with the
+// SQLSTATE code as retryable, e.g. "55P03" (lock_not_available).
+func RegisterRetryableCode(code string) {
+	retryable.mu.Lock()
+	retryable.codes[code] = struct{}{}
+	retryable.mu.Unlock()
+}
+
+// RegisterRetryable makes IsRetryable report errors for which the fn
+// returns true as retryable. The fn is called with the err passed to
+// IsRetryable and must be safe for concurrent use.
+func RegisterRetryable(fn func(err error) bool) {
+	retryable.mu.Lock()
+	retryable.funcs = append(retryable.funcs, fn)
+	retryable.mu.Unlock()
+}
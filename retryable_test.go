@@ -0,0 +1,60 @@
+package sharding_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/go-pg/sharding"
+)
+
+type pgError struct {
+	code string
+}
+
+func (e pgError) Error() string {
+	return "ERROR #" + e.code
+}
+
+func (e pgError) Field(field byte) string {
+	if field == 'C' {
+		return e.code
+	}
+	return ""
+}
+
+func (e pgError) IntegrityViolation() bool {
+	return false
+}
+
+func TestIsRetryable(t *testing.T) {
+	errFake := errors.New("fake error")
+	sharding.RegisterRetryableCode("55P03")
+	sharding.RegisterRetryable(func(err error) bool {
+		return err == errFake
+	})
+
+	tests := []struct {
+		err    error
+		wanted bool
+	}{
+		{nil, false},
+		{errors.New("other error"), false},
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{pgError{"08006"}, true},
+		{pgError{"57P01"}, true},
+		{pgError{"40001"}, true},
+		{pgError{"40P01"}, true},
+		{pgError{"23505"}, false},
+		{pgError{"55P03"}, true},
+		{&sharding.ShardError{ShardId: 1, Err: pgError{"40001"}}, true},
+		{&sharding.ShardError{ShardId: 1, Err: pgError{"23505"}}, false},
+		{errFake, true},
+	}
+	for _, test := range tests {
+		if got := sharding.IsRetryable(test.err); got != test.wanted {
+			t.Errorf("IsRetryable(%v) = %v, wanted %v", test.err, got, test.wanted)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package sharding
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/go-pg/pg"
+)
+
+// ringReplicas is number of points each db has on the hash ring.
+const ringReplicas = 128
+
+type ringPoint struct {
+	hash uint64
+	db   *pg.DB
+}
+
+// ringPlacement places nshards on the dbs using consistent hashing. Each
+// occurrence of the server in dbs adds ringReplicas points to the ring,
+// so listing the server several times gives it proportionally more
+// shards. Shards are placed on the first db passed for each server.
+func ringPlacement(dbs []*pg.DB, nshards int) []*pg.DB {
+	var keys []string
+	servers := make(map[string]*pg.DB)
+	weights := make(map[string]int)
+	for _, db := range dbs {
+		key := serverKey(db)
+		if _, ok := servers[key]; !ok {
+			servers[key] = db
+			keys = append(keys, key)
+		}
+		weights[key]++
+	}
+
+	var ring []ringPoint
+	for _, key := range keys {
+		for i := 0; i < weights[key]*ringReplicas; i++ {
+			ring = append(ring, ringPoint{
+				hash: fnvHash([]byte(key + "#" + strconv.Itoa(i))),
+				db:   servers[key],
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return serverKey(ring[i].db) < serverKey(ring[j].db)
+	})
+
+	placement := make([]*pg.DB, nshards)
+	for i := range placement {
+		h := fnvHash([]byte("shard" + strconv.Itoa(i)))
+		ind := sort.Search(len(ring), func(j int) bool {
+			return ring[j].hash >= h
+		})
+		if ind == len(ring) {
+			ind = 0
+		}
+		placement[i] = ring[ind].db
+	}
+	return placement
+}
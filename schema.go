@@ -0,0 +1,323 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/go-pg/pg"
+)
+
+// MissingSchemasError is returned by VerifySchemas when schemas of some
+// shards do not exist on their servers.
+type MissingSchemasError struct {
+	// Missing maps every server that needs bootstrapping to sorted ids
+	// of shards which schemas do not exist on the server.
+	Missing map[*pg.DB][]int64
+}
+
+func (e *MissingSchemasError) Error() string {
+	keys := make([]string, 0, len(e.Missing))
+	missing := make(map[string][]int64, len(e.Missing))
+	for db, ids := range e.Missing {
+		key := serverKey(db)
+		keys = append(keys, key)
+		missing[key] = ids
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString("sharding: missing schemas:")
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteString(":")
+		for j, id := range missing[key] {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(" shard")
+			b.WriteString(strconv.FormatInt(id, 10))
+		}
+	}
+	return b.String()
+}
+
+// VerifySchemas checks that schema of every shard exists on the server
+// the shard is placed on. Schemas are looked up in pg_catalog, so the
+// check does not depend on privileges of the user. It returns
+// *MissingSchemasError that lists missing schemas per server.
+func (cl *Cluster) VerifySchemas(ctx context.Context) error {
+	var mu sync.Mutex
+	missing := make(map[*pg.DB][]int64)
+	err := cl.ForEachDB(func(db *pg.DB) error {
+		// db may be bound to the cluster context,
+		// so it is compared by server.
+		server := cl.server(db)
+
+		var names []string
+		ids := make(map[string]int64)
+		for i, shardServer := range cl.shardServers {
+			if shardServer == server {
+				name := "shard" + strconv.Itoa(i)
+				names = append(names, name)
+				ids[name] = int64(i)
+			}
+		}
+
+		var existing []string
+		_, err := db.WithContext(ctx).QueryOne(pg.Scan(pg.Array(&existing)), `
+			SELECT array_agg(nspname) FROM pg_catalog.pg_namespace
+			WHERE nspname = ANY(?)`, pg.Array(names))
+		if err != nil {
+			return err
+		}
+		for _, name := range existing {
+			delete(ids, name)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		shardIds := make([]int64, 0, len(ids))
+		for _, id := range ids {
+			shardIds = append(shardIds, id)
+		}
+		sort.Slice(shardIds, func(i, j int) bool {
+			return shardIds[i] < shardIds[j]
+		})
+
+		mu.Lock()
+		missing[server] = shardIds
+		mu.Unlock()
+		return nil
+	}, WithContext(ctx), WithDisabled())
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return &MissingSchemasError{
+			Missing: missing,
+		}
+	}
+	return nil
+}
+
+// NewClusterFromSchemas returns new cluster which shards are discovered
+// by listing shardN schemas that exist on the dbs rather than specified
+// by the caller. Discovered shard ids must be contiguous starting with
+// zero, every shard must exist on exactly one server and the number of
+// shards must not exceed capacity of the gen, which defaults to
+// DefaultIdGen.
+func NewClusterFromSchemas(
+	ctx context.Context, dbs []*pg.DB, gen *IdGen,
+) (*Cluster, error) {
+	if len(dbs) == 0 {
+		return nil, errors.New("sharding: at least one db is required")
+	}
+	for i, db := range dbs {
+		if db == nil {
+			return nil, fmt.Errorf("sharding: dbs[%d] is nil", i)
+		}
+	}
+	if gen == nil {
+		gen = DefaultIdGen
+	}
+
+	placement := make(map[int64]*pg.DB)
+	seen := make(map[string]struct{}, len(dbs))
+	for _, db := range dbs {
+		key := serverKey(db)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		var names []string
+		_, err := db.WithContext(ctx).QueryOne(pg.Scan(pg.Array(&names)), `
+			SELECT array_agg(nspname) FROM pg_catalog.pg_namespace
+			WHERE nspname ~ '^shard[0-9]+$'`)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			id, err := strconv.ParseInt(name[len("shard"):], 10, 64)
+			if err != nil || "shard"+strconv.FormatInt(id, 10) != name {
+				continue
+			}
+			if other, ok := placement[id]; ok {
+				return nil, fmt.Errorf(
+					"sharding: schema %s exists on %s and %s", name, serverKey(other), key)
+			}
+			placement[id] = db
+		}
+	}
+
+	nshards := int64(len(placement))
+	if nshards == 0 {
+		return nil, errors.New("sharding: no shard schemas found")
+	}
+	for id := int64(0); id < nshards; id++ {
+		if _, ok := placement[id]; !ok {
+			return nil, fmt.Errorf("sharding: shard ids are not contiguous: shard%d is missing", id)
+		}
+	}
+	if nshards > int64(gen.NumShards()) {
+		return nil, fmt.Errorf(
+			"sharding: nshards=%d exceeds IdGen capacity %d", nshards, gen.NumShards())
+	}
+
+	// Shard i is placed on dbs[i%len(dbs)], so use the shortest period of
+	// the placement that divides the number of shards as the dbs.
+	period := nshards
+	for p := int64(1); p < nshards; p++ {
+		if nshards%p != 0 {
+			continue
+		}
+		ok := true
+		for id := p; id < nshards; id++ {
+			if placement[id] != placement[id%p] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			period = p
+			break
+		}
+	}
+	clusterDBs := make([]*pg.DB, period)
+	for i := range clusterDBs {
+		clusterDBs[i] = placement[int64(i)]
+	}
+
+	return NewClusterWithOptions(clusterDBs, int(nshards), &ClusterOptions{
+		IdGen: gen,
+	}), nil
+}
+
+// SchemaPlacementError is returned by VerifySchemaPlacement when schemas
+// of some shards are not placed on the servers they are assigned to.
+type SchemaPlacementError struct {
+	// Missing contains sorted ids of shards which schemas do not exist
+	// on their assigned servers.
+	Missing []int64
+	// Misplaced maps ids of shards which schemas exist on servers other
+	// than their assigned servers to these servers sorted by address.
+	Misplaced map[int64][]*pg.DB
+}
+
+func (e *SchemaPlacementError) Error() string {
+	var b bytes.Buffer
+	b.WriteString("sharding: schemas are not placed as expected:")
+	if len(e.Missing) > 0 {
+		b.WriteString(" missing:")
+		for i, id := range e.Missing {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(" shard")
+			b.WriteString(strconv.FormatInt(id, 10))
+		}
+	}
+
+	ids := make([]int64, 0, len(e.Misplaced))
+	for id := range e.Misplaced {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	for i, id := range ids {
+		if i > 0 || len(e.Missing) > 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(" shard")
+		b.WriteString(strconv.FormatInt(id, 10))
+		b.WriteString(" is on")
+		for j, db := range e.Misplaced[id] {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteByte(' ')
+			b.WriteString(serverKey(db))
+		}
+	}
+	return b.String()
+}
+
+// VerifySchemaPlacement lists shardN schemas on every server and checks
+// that schema of every shard exists on the server the shard is assigned
+// to and on no other server, e.g. to detect drift after schemas were
+// moved manually. Schemas of shards with ids out of range of the cluster
+// are ignored. It returns *SchemaPlacementError that lists missing and
+// misplaced schemas.
+func (cl *Cluster) VerifySchemaPlacement(ctx context.Context) error {
+	var mu sync.Mutex
+	found := make(map[int64][]*pg.DB)
+	err := cl.ForEachDB(func(db *pg.DB) error {
+		var names []string
+		_, err := db.WithContext(ctx).QueryOne(pg.Scan(pg.Array(&names)), `
+			SELECT array_agg(nspname) FROM pg_catalog.pg_namespace
+			WHERE nspname ~ '^shard[0-9]+$'`)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, name := range names {
+			id, err := strconv.ParseInt(name[len("shard"):], 10, 64)
+			if err != nil || "shard"+strconv.FormatInt(id, 10) != name {
+				continue
+			}
+			if id < int64(len(cl.shards)) {
+				// db may be bound to the cluster context,
+				// so the server is recorded instead.
+				found[id] = append(found[id], cl.server(db))
+			}
+		}
+		return nil
+	}, WithContext(ctx), WithDisabled())
+	if err != nil {
+		return err
+	}
+
+	var missing []int64
+	misplaced := make(map[int64][]*pg.DB)
+	for i, server := range cl.shardServers {
+		id := int64(i)
+		ok := false
+		var others []*pg.DB
+		for _, db := range found[id] {
+			if db == server {
+				ok = true
+			} else {
+				others = append(others, db)
+			}
+		}
+		if !ok {
+			missing = append(missing, id)
+		}
+		if len(others) > 0 {
+			sort.Slice(others, func(i, j int) bool {
+				return serverKey(others[i]) < serverKey(others[j])
+			})
+			misplaced[id] = others
+		}
+	}
+	if len(missing) > 0 || len(misplaced) > 0 {
+		return &SchemaPlacementError{
+			Missing:   missing,
+			Misplaced: misplaced,
+		}
+	}
+	return nil
+}
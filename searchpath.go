@@ -0,0 +1,114 @@
+package sharding
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/go-pg/pg"
+)
+
+// searchPathPools contains pools of connections dedicated to a single
+// shard that are shared by the cluster and its copies.
+type searchPathPools struct {
+	appName string
+
+	mu sync.Mutex
+	m  map[searchPathKey]*pg.DB
+	// poolSizes contains pool size of every shard.
+	poolSizes []int
+}
+
+// searchPathKey identifies the pool by the db rather than by its
+// server, so dbs with different options, e.g. read-only dbs of disabled
+// servers, don't share connections.
+type searchPathKey struct {
+	db *pg.DB
+	id int64
+}
+
+func newSearchPathPools(appName string) *searchPathPools {
+	return &searchPathPools{
+		appName: appName,
+		m:       make(map[searchPathKey]*pg.DB),
+	}
+}
+
+// init divides PoolSize of every db between shards placed on it, so
+// the number of connections to a server stays within its PoolSize.
+func (p *searchPathPools) init(placement []*pg.DB) {
+	nshards := make(map[string]int)
+	for _, db := range placement {
+		nshards[serverKey(db)]++
+	}
+
+	poolSizes := make([]int, len(placement))
+	for i, db := range placement {
+		n := nshards[serverKey(db)]
+		poolSize := db.Options().PoolSize
+		if n > poolSize {
+			panic(fmt.Sprintf(
+				"sharding: SearchPath needs a connection per shard, but %s has %d shards and PoolSize=%d",
+				serverKey(db), n, poolSize))
+		}
+		poolSizes[i] = poolSize / n
+	}
+
+	p.mu.Lock()
+	p.poolSizes = poolSizes
+	p.mu.Unlock()
+}
+
+// get returns the pool of connections to the db server which
+// search_path is set to schema of the shard with the id. Connections
+// are tagged with application_name of the shard if appName is set.
+func (p *searchPathPools) get(db *pg.DB, id int64) *pg.DB {
+	name := "shard" + strconv.FormatInt(id, 10)
+	key := searchPathKey{db: db, id: id}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pool, ok := p.m[key]; ok {
+		return pool
+	}
+
+	opt := *db.Options()
+	opt.PoolSize = p.poolSizes[id]
+	if opt.MinIdleConns > opt.PoolSize {
+		opt.MinIdleConns = opt.PoolSize
+	}
+	onConnect := opt.OnConnect
+	opt.OnConnect = func(conn *pg.DB) error {
+		if onConnect != nil {
+			if err := onConnect(conn); err != nil {
+				return err
+			}
+		}
+		if _, err := conn.Exec(`SET search_path TO ?`, ShardIdent(name)); err != nil {
+			return err
+		}
+		if p.appName != "" {
+			_, err := conn.Exec(`SET application_name TO ?`, p.appName+"/"+name)
+			return err
+		}
+		return nil
+	}
+	pool := pg.Connect(&opt)
+	p.m[key] = pool
+	return pool
+}
+
+func (p *searchPathPools) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var retErr error
+	for key, pool := range p.m {
+		if err := pool.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+		delete(p.m, key)
+	}
+	return retErr
+}
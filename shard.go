@@ -0,0 +1,307 @@
+package sharding
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"github.com/go-pg/pg/types"
+)
+
+// PrepareShard creates a prepared statement on the shard. Unlike
+// pg.DB.Prepare it substitutes shard params such as ?shard and ?shard_id
+// before the statement is prepared, so the prepared plan targets the
+// shard's schema. Statement params must use $1, $2, ... placeholders.
+func PrepareShard(shard *pg.DB, q string) (*pg.Stmt, error) {
+	q = string(shard.FormatQuery(nil, q))
+	return shard.Prepare(q)
+}
+
+// ExecInt executes the query on the shard and returns number of
+// affected rows.
+func ExecInt(shard *pg.DB, query interface{}, params ...interface{}) (int, error) {
+	res, err := shard.Exec(query, params...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
+
+// ExecResult executes the query on the shard like pg.DB.Exec and also
+// returns the statement that was sent to the server, i.e. the query
+// formatted with shard params and the params, e.g. for audit logging.
+// The statement is formatted once, so it is exactly what was executed.
+func ExecResult(
+	shard *pg.DB, query interface{}, params ...interface{},
+) (orm.Result, string, error) {
+	var q []byte
+	switch query := query.(type) {
+	case string:
+		q = shard.FormatQuery(nil, query, params...)
+	case orm.QueryAppender:
+		var err error
+		q, err = query.AppendQuery(nil)
+		if err != nil {
+			return nil, "", err
+		}
+	default:
+		return nil, "", fmt.Errorf("sharding: can't append %T", query)
+	}
+
+	res, err := shard.Exec(formattedQuery(q))
+	return res, string(q), err
+}
+
+// formattedQuery is a query that is already formatted
+// and is sent to the server as is.
+type formattedQuery []byte
+
+var _ orm.QueryAppender = formattedQuery(nil)
+
+func (q formattedQuery) Copy() orm.QueryAppender {
+	return q
+}
+
+func (q formattedQuery) Query() *orm.Query {
+	return orm.NewQuery(nil)
+}
+
+func (q formattedQuery) AppendQuery(dst []byte) ([]byte, error) {
+	return append(dst, q...), nil
+}
+
+// RunInTransactionContext runs the fn in a transaction on the shard that
+// is cancelled as a unit when the ctx is done: the running statement is
+// cancelled with pg_cancel_backend, the transaction is rolled back and
+// ctx.Err() is returned. pg.DB.WithContext alone does not interrupt
+// queries. Like pg.DB.RunInTransaction it commits the transaction if the
+// fn returns nil and rolls it back if the fn returns an error or panics.
+func RunInTransactionContext(
+	ctx context.Context, shard *pg.DB, fn func(tx *pg.Tx) error,
+) error {
+	tx, err := BeginContext(ctx, shard)
+	if err != nil {
+		return err
+	}
+	return tx.RunInTransaction(fn)
+}
+
+// ContextTx is a transaction started with BeginContext. Statements are
+// executed with the embedded pg.Tx and are cancelled when the ctx is done.
+type ContextTx struct {
+	*pg.Tx
+
+	ctx     context.Context
+	once    sync.Once
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// BeginContext starts a transaction on the shard that is cancelled like
+// RunInTransactionContext does when the ctx is done. Commit or Rollback
+// must be called to return the connection to the pool; Commit returns
+// ctx.Err() and rolls the transaction back if the ctx is done.
+func BeginContext(ctx context.Context, shard *pg.DB) (*ContextTx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	shard = shard.WithContext(ctx)
+	pgTx, err := shard.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var pid int
+	_, err = pgTx.QueryOne(pg.Scan(&pid), `SELECT pg_backend_pid()`)
+	if err != nil {
+		_ = pgTx.Rollback()
+		return nil, err
+	}
+
+	tx := &ContextTx{
+		Tx:      pgTx,
+		ctx:     ctx,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go func() {
+		defer close(tx.stopped)
+		select {
+		case <-ctx.Done():
+			_, _ = shard.WithContext(context.Background()).
+				Exec(`SELECT pg_cancel_backend(?)`, pid)
+		case <-tx.stop:
+		}
+	}()
+	return tx, nil
+}
+
+// stopWatch stops the watcher. It must be called before the connection
+// is returned to the pool, so the watcher never cancels other queries.
+func (tx *ContextTx) stopWatch() {
+	tx.once.Do(func() {
+		close(tx.stop)
+	})
+	<-tx.stopped
+}
+
+// Commit commits the transaction. If the ctx is done, the transaction is
+// rolled back and ctx.Err() is returned.
+func (tx *ContextTx) Commit() error {
+	tx.stopWatch()
+	if err := tx.ctx.Err(); err != nil {
+		_ = tx.Tx.Rollback()
+		return err
+	}
+	return tx.Tx.Commit()
+}
+
+// Rollback aborts the transaction.
+func (tx *ContextTx) Rollback() error {
+	tx.stopWatch()
+	return tx.Tx.Rollback()
+}
+
+// RunInTransaction runs the fn in the transaction. It commits the
+// transaction if the fn returns nil and rolls it back if the fn returns
+// an error or panics. ctx.Err() is returned if the ctx is done.
+func (tx *ContextTx) RunInTransaction(fn func(tx *pg.Tx) error) error {
+	defer func() {
+		if err := recover(); err != nil {
+			_ = tx.Rollback()
+			panic(err)
+		}
+	}()
+	if err := fn(tx.Tx); err != nil {
+		_ = tx.Rollback()
+		if ctxErr := tx.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// RunInTx is like RunInTransactionContext, but uses the context the
+// shard is bound to, e.g. with Cluster.WithContext. It commits the
+// transaction if the fn returns nil and rolls it back if the fn returns
+// an error or panics, so the transaction is never leaked.
+func RunInTx(shard *pg.DB, fn func(tx *pg.Tx) error) error {
+	if fn == nil {
+		panic("sharding: RunInTx is called with nil fn")
+	}
+	return RunInTransactionContext(shard.Context(), shard, fn)
+}
+
+// CopyFromSlice copies the rows into the columns of the table in the
+// shard's schema using COPY FROM STDIN and returns number of copied rows.
+// Values are encoded in COPY text format the same way go-pg formats
+// query params; nil values are copied as NULL. Rows are streamed to the
+// server while they are encoded. Like CopyFrom, it returns an error if
+// the server did not report the number of rows.
+func CopyFromSlice(
+	shard *pg.DB, table string, columns []string, rows [][]interface{},
+) (int, error) {
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		quoted[i] = quoteIdent(col)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeCopyRows(pw, rows))
+	}()
+
+	n, err := CopyFrom(shard, pr, `COPY ?shard.? (?) FROM STDIN`,
+		types.Q(quoteIdent(table)), types.Q(strings.Join(quoted, ", ")))
+	// Unblock the writer if COPY failed before reading all rows.
+	pr.CloseWithError(io.ErrClosedPipe)
+	return n, err
+}
+
+// CopyFrom copies data from the r into the shard like pg.DB.CopyFrom
+// and returns number of copied rows parsed from the COPY command tag.
+// It returns an error if the server did not report the number of rows,
+// which PostgreSQL does since 8.2.
+func CopyFrom(shard *pg.DB, r io.Reader, query interface{}, params ...interface{}) (int, error) {
+	res, err := shard.CopyFrom(r, query, params...)
+	if err != nil {
+		return 0, err
+	}
+	n := res.RowsAffected()
+	if n < 0 {
+		return 0, errors.New("sharding: COPY did not report number of rows")
+	}
+	return n, nil
+}
+
+func writeCopyRows(w io.Writer, rows [][]interface{}) error {
+	bw := bufio.NewWriter(w)
+	b := make([]byte, 0, 64)
+	for _, row := range rows {
+		for i, v := range row {
+			if i > 0 {
+				bw.WriteByte('\t')
+			}
+			b = appendCopyValue(bw, b[:0], v)
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// appendCopyValue writes the v escaped for COPY text format to the w
+// using the b as a scratch buffer, which is returned for reuse.
+func appendCopyValue(w *bufio.Writer, b []byte, v interface{}) []byte {
+	if v == nil {
+		w.WriteString(`\N`)
+		return b
+	}
+	// b is not nil, so nil means types.Append formatted NULL.
+	b = types.Append(b, v, 0)
+	if b == nil {
+		w.WriteString(`\N`)
+		return make([]byte, 0, 64)
+	}
+	for _, c := range b {
+		switch c {
+		case '\\':
+			w.WriteString(`\\`)
+		case '\t':
+			w.WriteString(`\t`)
+		case '\n':
+			w.WriteString(`\n`)
+		case '\r':
+			w.WriteString(`\r`)
+		default:
+			w.WriteByte(c)
+		}
+	}
+	return b
+}
+
+// QueryInto runs the query on the shard and returns rows decoded into
+// a new slice of T.
+func QueryInto[T any](shard *pg.DB, query interface{}, params ...interface{}) ([]T, error) {
+	var rows []T
+	if _, err := shard.Query(&rows, query, params...); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// QueryScalar runs the query on the shard and scans the single value it
+// returns into the dest, e.g. max(id) or count(*). It returns
+// pg.ErrNoRows or pg.ErrMultiRows if the query does not return exactly
+// one row and an error if the row has more than one column.
+func QueryScalar(shard *pg.DB, dest interface{}, query interface{}, params ...interface{}) error {
+	_, err := shard.QueryOne(pg.Scan(dest), query, params...)
+	return err
+}
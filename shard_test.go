@@ -0,0 +1,33 @@
+package sharding_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/go-pg/sharding"
+)
+
+func TestWriteCopyRows(t *testing.T) {
+	var nilPtr *string
+	tm := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	rows := [][]interface{}{
+		{1, "hello", nil},
+		{int64(-2), "tab\there\nnew\\line\r", nilPtr},
+		{true, "", []byte{0x01, 0xff}},
+		{1.5, tm, "\\N"},
+	}
+
+	var buf bytes.Buffer
+	if err := sharding.WriteCopyRows(&buf, rows); err != nil {
+		t.Fatal(err)
+	}
+
+	wanted := "1\thello\t\\N\n" +
+		"-2\ttab\\there\\nnew\\\\line\\r\t\\N\n" +
+		"TRUE\t\t\\\\x01ff\n" +
+		"1.5\t2020-01-02 03:04:05+00:00:00\t\\\\N\n"
+	if got := buf.String(); got != wanted {
+		t.Fatalf("got %q, wanted %q", got, wanted)
+	}
+}
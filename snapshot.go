@@ -0,0 +1,53 @@
+package sharding
+
+import (
+	"github.com/go-pg/pg"
+)
+
+// ClusterSnapshot is a point-in-time view of the cluster routing. Servers
+// disabled with DisableServer and their read-only replacements are
+// frozen when the snapshot is taken, so a long-running job that uses the
+// snapshot is not affected by servers that are disabled or enabled on the
+// cluster while the job is running. The snapshot shares connections with
+// the cluster.
+type ClusterSnapshot struct {
+	cl *Cluster
+}
+
+// Snapshot returns a snapshot of the cluster routing.
+func (cl *Cluster) Snapshot() *ClusterSnapshot {
+	clone := *cl
+	clone.disabled = new(disabledState)
+	clone.disabled.v.Store(cl.loadDisabled())
+	return &ClusterSnapshot{
+		cl: &clone,
+	}
+}
+
+// Shard maps the number to the corresponding shard like Cluster.Shard.
+func (s *ClusterSnapshot) Shard(number int64) *pg.DB {
+	return s.cl.Shard(number)
+}
+
+// SplitShard routes the id to the shard like Cluster.SplitShard.
+func (s *ClusterSnapshot) SplitShard(id int64) *pg.DB {
+	return s.cl.SplitShard(id)
+}
+
+// Shards returns list of shards running in the db like Cluster.Shards.
+func (s *ClusterSnapshot) Shards(db *pg.DB) []*pg.DB {
+	return s.cl.Shards(db)
+}
+
+// IsServerDisabled reports whether the db was disabled with DisableServer
+// when the snapshot was taken.
+func (s *ClusterSnapshot) IsServerDisabled(db *pg.DB) bool {
+	return s.cl.IsServerDisabled(db)
+}
+
+// ForEachShard concurrently calls the fn on each shard like
+// Cluster.ForEachShard. Servers that were disabled when the snapshot was
+// taken are skipped unless WithDisabled option is used.
+func (s *ClusterSnapshot) ForEachShard(fn func(shard *pg.DB) error, opts ...ForEachOption) error {
+	return s.cl.ForEachShard(fn, opts...)
+}
@@ -0,0 +1,29 @@
+package sharding
+
+import (
+	"errors"
+)
+
+// ErrPoolTimeout is returned by ForEach* methods instead of the go-pg
+// error when fn fails, because no connection was available in the
+// server's pool within ClusterOptions.PoolTimeout. Queries executed on
+// shards directly return the go-pg error; use IsPoolTimeout to check
+// for both.
+var ErrPoolTimeout = errors.New("sharding: connection pool timeout")
+
+// go-pg keeps its pool timeout error in an internal package, so it is
+// matched by message.
+const pgPoolTimeout = "pg: connection pool timeout"
+
+// IsPoolTimeout reports whether the err is caused by pool timeout,
+// either ErrPoolTimeout or the error returned by go-pg.
+func IsPoolTimeout(err error) bool {
+	return err != nil && (err == ErrPoolTimeout || err.Error() == pgPoolTimeout)
+}
+
+func wrapPoolTimeout(err error) error {
+	if IsPoolTimeout(err) {
+		return ErrPoolTimeout
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package sharding
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// Tracer creates spans for shard operations. It is a small subset of
+// OpenTelemetry trace.Tracer, so the package does not depend on OTel;
+// an adapter usually starts the span with trace.WithTimestamp(start) and
+// converts attrs to attribute.KeyValue.
+type Tracer interface {
+	// Start starts the span that is a child of the span in the ctx and
+	// returns the ctx with the new span.
+	Start(
+		ctx context.Context, name string, start time.Time, attrs map[string]interface{},
+	) (context.Context, Span)
+}
+
+// Span is a span started by Tracer.
+type Span interface {
+	// End ends the span and records the err if it is not nil.
+	End(err error)
+}
+
+func (cl *Cluster) addTracer(shard *pg.DB, id int64) {
+	tracer := cl.opt.Tracer
+	shard.OnQueryProcessed(func(ev *pg.QueryProcessedEvent) {
+		ctx := context.Background()
+		if db, ok := ev.DB.(interface{ Context() context.Context }); ok {
+			ctx = db.Context()
+		}
+
+		// Args are never included in the statement so it does not
+		// leak user data.
+		query, err := ev.UnformattedQuery()
+		if err == nil {
+			query = string(shard.FormatQuery(nil, query))
+		} else {
+			query = err.Error()
+		}
+
+		_, span := tracer.Start(ctx, "sharding.query", ev.StartTime, map[string]interface{}{
+			"db.system":    "postgresql",
+			"db.shard_id":  id,
+			"db.statement": query,
+		})
+		span.End(ev.Error)
+	})
+}
+
+// traceForEachShard wraps the fn so it is called with the shard bound to
+// the child span of the ForEachShard span in the ctx.
+func (cl *Cluster) traceForEachShard(
+	ctx context.Context, fn func(shard *pg.DB) error,
+) func(shard *pg.DB) error {
+	return func(shard *pg.DB) error {
+		ctx, span := cl.opt.Tracer.Start(ctx, "sharding.shard", time.Now(), map[string]interface{}{
+			"db.system":   "postgresql",
+			"db.shard_id": ShardId(shard),
+		})
+		err := fn(shard.WithContext(ctx))
+		span.End(err)
+		return err
+	}
+}
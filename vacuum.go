@@ -0,0 +1,97 @@
+package sharding
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/types"
+)
+
+// VacuumOptions configures Vacuum.
+type VacuumOptions struct {
+	// Full runs VACUUM FULL, which rewrites tables and locks them
+	// exclusively.
+	Full bool
+	// Freeze runs VACUUM FREEZE.
+	Freeze bool
+	// Analyze runs VACUUM ANALYZE to update planner statistics.
+	Analyze bool
+}
+
+func (opt *VacuumOptions) query() string {
+	var b bytes.Buffer
+	b.WriteString("VACUUM ")
+	var n int
+	for _, o := range []struct {
+		on   bool
+		name string
+	}{
+		{opt.Full, "FULL"},
+		{opt.Freeze, "FREEZE"},
+		{opt.Analyze, "ANALYZE"},
+	} {
+		if !o.on {
+			continue
+		}
+		if n == 0 {
+			b.WriteByte('(')
+		} else {
+			b.WriteString(", ")
+		}
+		b.WriteString(o.name)
+		n++
+	}
+	if n > 0 {
+		b.WriteString(") ")
+	}
+	b.WriteString("?shard.?")
+	return b.String()
+}
+
+// Vacuum runs VACUUM on every table in the schema of every shard.
+// VACUUM can't run in a transaction block, so every table is vacuumed
+// with a separate statement in autocommit mode. Shards are processed one
+// at a time on each server and concurrently across servers. Shards on
+// servers disabled with DisableServer are skipped.
+//
+// It returns outcome of every processed shard, which includes time spent
+// vacuuming the shard, and *ShardsError if some of the shards failed.
+func (cl *Cluster) Vacuum(ctx context.Context, opt *VacuumOptions) ([]ShardOutcome, error) {
+	if opt == nil {
+		opt = new(VacuumOptions)
+	}
+	query := opt.query()
+
+	outcomes := cl.ForEachShardResult(func(shard *pg.DB) error {
+		shard = shard.WithContext(ctx)
+
+		var tables []string
+		_, err := shard.QueryOne(pg.Scan(pg.Array(&tables)), `
+			SELECT coalesce(array_agg(tablename ORDER BY tablename), '{}')
+			FROM pg_catalog.pg_tables WHERE schemaname = ?`,
+			"shard"+strconv.FormatInt(ShardId(shard), 10))
+		if err != nil {
+			return err
+		}
+
+		for _, table := range tables {
+			if _, err := shard.Exec(query, types.Q(quoteIdent(table))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, WithContext(ctx), WithConcurrency(1))
+
+	errs := new(ShardsError)
+	for _, outcome := range outcomes {
+		if outcome.Err != nil {
+			errs.add(outcome.ShardId, outcome.Err)
+		}
+	}
+	if len(errs.Errors) > 0 {
+		return outcomes, errs
+	}
+	return outcomes, nil
+}